@@ -1,27 +1,117 @@
-package main
+package toxiproxy
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
 	"net"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 )
 
-type server struct {
-	collection *ProxyCollection
+// ApiServer serves the HTTP API for a collection of proxies. It can also be
+// used directly, e.g. to run proxies inside a Go test.
+type ApiServer struct {
+	Collection *ProxyCollection
+	// Whether every request needs one of Tokens. With no tokens, every request
+	// is refused
+	RequireTokens bool
+	// Tokens allowed to use the API
+	Tokens []APIToken
+	// Serve the API over TLS if set
+	TLSConfig *tls.Config
+	// Directory the API can write traffic recordings to. Recording through the
+	// API is refused if empty
+	RecordDir string
+
+	sync.Mutex
+	httpServer *http.Server
 }
 
-func NewServer(collection *ProxyCollection) *server {
-	return &server{
-		collection: collection,
+func NewServer() *ApiServer {
+	return &ApiServer{
+		Collection: NewProxyCollection(),
 	}
 }
 
-func (server *server) Listen(host string, port string) {
+// Listen serves the API on host and port, blocking until the server is closed.
+func (server *ApiServer) Listen(host string, port string) error {
+	logrus.WithFields(logrus.Fields{
+		"host":    host,
+		"port":    port,
+		"version": Version,
+		"tls":     server.TLSConfig != nil,
+	}).Info("API HTTP server starting")
+
+	httpServer := &http.Server{
+		Addr:      net.JoinHostPort(host, port),
+		Handler:   server.Handler(),
+		TLSConfig: server.TLSConfig,
+	}
+	server.Lock()
+	server.httpServer = httpServer
+	server.Unlock()
+
+	var err error
+	if server.TLSConfig != nil {
+		// The certificates are already loaded in the TLS config
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// CreateProxy creates and starts a proxy from listen to upstream. Listening on
+// port 0 picks a free port, which is then set in the proxy's Listen field.
+func (server *ApiServer) CreateProxy(name, listen, upstream string) (*Proxy, error) {
+	if IsMockUpstream(upstream) {
+		_, err := ParseMockUpstream(upstream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	proxy := NewProxy()
+	proxy.Name = name
+	proxy.Listen = listen
+	proxy.Upstream = upstream
+
+	err := server.Collection.Add(proxy, true)
+	if err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// Close stops the API, if it's listening, and removes all proxies.
+func (server *ApiServer) Close() error {
+	server.Lock()
+	httpServer := server.httpServer
+	server.httpServer = nil
+	server.Unlock()
+
+	// Proxies are stopped even if the HTTP server fails to close
+	err := server.Collection.Clear()
+	if httpServer != nil {
+		if closeErr := httpServer.Close(); closeErr != nil {
+			return closeErr
+		}
+	}
+	return err
+}
+
+// Handler returns the http.Handler serving the API.
+func (server *ApiServer) Handler() http.Handler {
 	r := mux.NewRouter()
 	r.HandleFunc("/reset", server.ResetState).Methods("GET")
 	r.HandleFunc("/proxies", server.ProxyIndex).Methods("GET")
@@ -33,24 +123,21 @@ func (server *server) Listen(host string, port string) {
 	r.HandleFunc("/proxies/{proxy}/downstream/toxics", server.ToxicIndexDownstream).Methods("GET")
 	r.HandleFunc("/proxies/{proxy}/upstream/toxics/{toxic}", server.ToxicSetUpstream).Methods("POST")
 	r.HandleFunc("/proxies/{proxy}/downstream/toxics/{toxic}", server.ToxicSetDownstream).Methods("POST")
+	r.HandleFunc("/proxies/{proxy}/record", server.RecordShow).Methods("GET")
+	r.HandleFunc("/proxies/{proxy}/record", server.RecordUpdate).Methods("POST")
+	r.HandleFunc("/proxies/{proxy}/rules/{rule}/{direction:upstream|downstream}/toxics", server.RuleToxicIndex).Methods("GET")
+	r.HandleFunc("/proxies/{proxy}/rules/{rule}/{direction:upstream|downstream}/toxics/{toxic}", server.RuleToxicSet).Methods("POST")
+	r.HandleFunc("/proxies/{proxy}/accept", server.AcceptShow).Methods("GET")
+	r.HandleFunc("/proxies/{proxy}/accept", server.AcceptUpdate).Methods("POST")
+	r.HandleFunc("/toxics/types", server.ToxicTypeIndex).Methods("GET")
 
 	r.HandleFunc("/version", server.Version).Methods("GET")
-	http.Handle("/", r)
-
-	logrus.WithFields(logrus.Fields{
-		"host":    host,
-		"port":    port,
-		"version": Version,
-	}).Info("API HTTP server starting")
 
-	err := http.ListenAndServe(net.JoinHostPort(host, port), nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
-	}
+	return server.authenticate(r)
 }
 
-func (server *server) ProxyIndex(response http.ResponseWriter, request *http.Request) {
-	proxies := server.collection.Proxies()
+func (server *ApiServer) ProxyIndex(response http.ResponseWriter, request *http.Request) {
+	proxies := server.Collection.Proxies()
 	marshalData := make(map[string]interface{}, len(proxies))
 
 	for name, proxy := range proxies {
@@ -71,8 +158,8 @@ func (server *server) ProxyIndex(response http.ResponseWriter, request *http.Req
 	}
 }
 
-func (server *server) ResetState(response http.ResponseWriter, request *http.Request) {
-	proxies := server.collection.Proxies()
+func (server *ApiServer) ResetState(response http.ResponseWriter, request *http.Request) {
+	proxies := server.Collection.Proxies()
 
 	for _, proxy := range proxies {
 		err := proxy.Start()
@@ -82,8 +169,12 @@ func (server *server) ResetState(response http.ResponseWriter, request *http.Req
 			return
 		}
 
+		proxy.Resume()
 		proxy.upToxics.ResetToxics()
 		proxy.downToxics.ResetToxics()
+		for _, toxics := range proxy.allRuleToxics() {
+			toxics.ResetToxics()
+		}
 	}
 
 	response.WriteHeader(http.StatusNoContent)
@@ -93,7 +184,7 @@ func (server *server) ResetState(response http.ResponseWriter, request *http.Req
 	}
 }
 
-func (server *server) ProxyCreate(response http.ResponseWriter, request *http.Request) {
+func (server *ApiServer) ProxyCreate(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 
 	// Default fields enable to proxy right away
@@ -108,17 +199,51 @@ func (server *server) ProxyCreate(response http.ResponseWriter, request *http.Re
 		http.Error(response, server.apiError(errors.New("Missing required field: name"), http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	if len(input.Upstream) < 1 {
+	if len(input.Upstream) < 1 && input.CassetteMode != CassetteModeReplay && input.Frontend == "" {
 		http.Error(response, server.apiError(errors.New("Missing required field: upstream"), http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
+	err = validateCassette(&input)
+	if err == nil {
+		err = validateLimits(&input)
+	}
+	if err == nil {
+		err = validateFrontend(&input)
+	}
+	if err == nil {
+		err = validateProxyProtocol(&input)
+	}
+	if err == nil {
+		err = validateListen(&input)
+	}
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if IsMockUpstream(input.Upstream) {
+		_, err = ParseMockUpstream(input.Upstream)
+		if err != nil {
+			http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
 
 	proxy := NewProxy()
 	proxy.Name = input.Name
 	proxy.Listen = input.Listen
 	proxy.Upstream = input.Upstream
-
-	err = server.collection.Add(proxy, input.Enabled)
+	proxy.Cassette = input.Cassette
+	proxy.CassetteMode = input.CassetteMode
+	proxy.CassetteMatch = input.CassetteMatch
+	proxy.MaxConnections = input.MaxConnections
+	proxy.QueueConnections = input.QueueConnections
+	proxy.AcceptRate = input.AcceptRate
+	proxy.Frontend = input.Frontend
+	proxy.setRules(input.Rules)
+	proxy.AcceptProxyProtocol = input.AcceptProxyProtocol
+	proxy.SendProxyProtocol = input.SendProxyProtocol
+
+	err = server.Collection.Add(proxy, input.Enabled)
 	if err != nil {
 		http.Error(response, server.apiError(err, http.StatusConflict), http.StatusConflict)
 		return
@@ -137,23 +262,64 @@ func (server *server) ProxyCreate(response http.ResponseWriter, request *http.Re
 	}
 }
 
-func (server *server) ProxyUpdate(response http.ResponseWriter, request *http.Request) {
+func (server *ApiServer) ProxyUpdate(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(request)
 
-	proxy, err := server.collection.Get(vars["proxy"])
+	proxy, err := server.Collection.Get(vars["proxy"])
 	if err != nil {
 		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
 	// Default fields are the same as existing proxy
-	input := Proxy{Listen: proxy.Listen, Upstream: proxy.Upstream, Enabled: proxy.Enabled}
+	input := Proxy{
+		Listen:        proxy.Listen,
+		Upstream:      proxy.Upstream,
+		Enabled:       proxy.Enabled,
+		Cassette:      proxy.Cassette,
+		CassetteMode:  proxy.CassetteMode,
+		CassetteMatch: proxy.CassetteMatch,
+
+		MaxConnections:   proxy.MaxConnections,
+		QueueConnections: proxy.QueueConnections,
+		AcceptRate:       proxy.AcceptRate,
+
+		Frontend: proxy.Frontend,
+		Rules:    proxy.copyRules(),
+
+		AcceptProxyProtocol: proxy.AcceptProxyProtocol,
+		SendProxyProtocol:   proxy.SendProxyProtocol,
+	}
 	err = json.NewDecoder(request.Body).Decode(&input)
 	if err != nil {
 		http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
+	err = validateCassette(&input)
+	if err == nil {
+		err = validateLimits(&input)
+	}
+	if err == nil {
+		err = validateFrontend(&input)
+	}
+	if err == nil {
+		err = validateProxyProtocol(&input)
+	}
+	if err == nil {
+		err = validateListen(&input)
+	}
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if IsMockUpstream(input.Upstream) {
+		_, err = ParseMockUpstream(input.Upstream)
+		if err != nil {
+			http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
 
 	err = proxy.Update(&input)
 	if err != nil {
@@ -173,10 +339,10 @@ func (server *server) ProxyUpdate(response http.ResponseWriter, request *http.Re
 	}
 }
 
-func (server *server) ProxyDelete(response http.ResponseWriter, request *http.Request) {
+func (server *ApiServer) ProxyDelete(response http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 
-	err := server.collection.Remove(vars["proxy"])
+	err := server.Collection.Remove(vars["proxy"])
 	if err != nil {
 		response.Header().Set("Content-Type", "application/json")
 		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
@@ -190,11 +356,11 @@ func (server *server) ProxyDelete(response http.ResponseWriter, request *http.Re
 	}
 }
 
-func (server *server) ProxyShow(response http.ResponseWriter, request *http.Request) {
+func (server *ApiServer) ProxyShow(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(request)
 
-	proxy, err := server.collection.Get(vars["proxy"])
+	proxy, err := server.Collection.Get(vars["proxy"])
 	if err != nil {
 		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
 		return
@@ -212,11 +378,11 @@ func (server *server) ProxyShow(response http.ResponseWriter, request *http.Requ
 	}
 }
 
-func (server *server) ToxicIndexUpstream(response http.ResponseWriter, request *http.Request) {
+func (server *ApiServer) ToxicIndexUpstream(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(request)
 
-	proxy, err := server.collection.Get(vars["proxy"])
+	proxy, err := server.Collection.Get(vars["proxy"])
 	if err != nil {
 		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
 		return
@@ -234,11 +400,11 @@ func (server *server) ToxicIndexUpstream(response http.ResponseWriter, request *
 	}
 }
 
-func (server *server) ToxicIndexDownstream(response http.ResponseWriter, request *http.Request) {
+func (server *ApiServer) ToxicIndexDownstream(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(request)
 
-	proxy, err := server.collection.Get(vars["proxy"])
+	proxy, err := server.Collection.Get(vars["proxy"])
 	if err != nil {
 		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
 		return
@@ -256,11 +422,11 @@ func (server *server) ToxicIndexDownstream(response http.ResponseWriter, request
 	}
 }
 
-func (server *server) ToxicSetUpstream(response http.ResponseWriter, request *http.Request) {
+func (server *ApiServer) ToxicSetUpstream(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(request)
 
-	proxy, err := server.collection.Get(vars["proxy"])
+	proxy, err := server.Collection.Get(vars["proxy"])
 	if err != nil {
 		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
 		return
@@ -284,11 +450,11 @@ func (server *server) ToxicSetUpstream(response http.ResponseWriter, request *ht
 	}
 }
 
-func (server *server) ToxicSetDownstream(response http.ResponseWriter, request *http.Request) {
+func (server *ApiServer) ToxicSetDownstream(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(request)
 
-	proxy, err := server.collection.Get(vars["proxy"])
+	proxy, err := server.Collection.Get(vars["proxy"])
 	if err != nil {
 		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
 		return
@@ -312,7 +478,244 @@ func (server *server) ToxicSetDownstream(response http.ResponseWriter, request *
 	}
 }
 
-func (server *server) Version(response http.ResponseWriter, request *http.Request) {
+func (server *ApiServer) RuleToxicIndex(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(request)
+
+	proxy, err := server.Collection.Get(vars["proxy"])
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	toxics, err := proxy.ruleToxics(vars["rule"], vars["direction"])
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(toxics.GetToxicMap())
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = response.Write(data)
+	if err != nil {
+		logrus.Warn("RuleToxicIndex: Failed to write response to client", err)
+	}
+}
+
+func (server *ApiServer) RuleToxicSet(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(request)
+
+	proxy, err := server.Collection.Get(vars["proxy"])
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	toxics, err := proxy.ruleToxics(vars["rule"], vars["direction"])
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	toxic, err := toxics.SetToxicJson(vars["toxic"], request.Body)
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(toxic)
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = response.Write(data)
+	if err != nil {
+		logrus.Warn("RuleToxicSet: Failed to write response to client", err)
+	}
+}
+
+func (server *ApiServer) RecordShow(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(request)
+
+	proxy, err := server.Collection.Get(vars["proxy"])
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	proxy.recorder.Lock()
+	data, err := json.Marshal(proxy.recorder)
+	proxy.recorder.Unlock()
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = response.Write(data)
+	if err != nil {
+		logrus.Warn("RecordShow: Failed to write response to client", err)
+	}
+}
+
+func (server *ApiServer) RecordUpdate(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(request)
+
+	proxy, err := server.Collection.Get(vars["proxy"])
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// Default fields are the same as the existing recording
+	proxy.recorder.Lock()
+	input := Recorder{Enabled: proxy.recorder.Enabled, Path: proxy.recorder.Path}
+	proxy.recorder.Unlock()
+	err = json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if input.Enabled && input.Path != "" {
+		input.Path, err = recordPath(server.RecordDir, input.Path)
+		if err != nil {
+			http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = proxy.updateRecorder(input.Enabled, input.Path)
+	if err == ErrRecorderMissingPath {
+		http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(response, server.apiError(err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	proxy.recorder.Lock()
+	data, err := json.Marshal(proxy.recorder)
+	proxy.recorder.Unlock()
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = response.Write(data)
+	if err != nil {
+		logrus.Warn("RecordUpdate: Failed to write response to client", err)
+	}
+}
+
+var ErrRecordDirMissing = errors.New("Recording is disabled, start toxiproxy with -record-dir")
+
+// Returns the path of a capture file, which must be inside the record
+// directory. Relative paths are taken from the directory.
+func recordPath(dir, path string) (string, error) {
+	if dir == "" {
+		return "", ErrRecordDirMissing
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid path: must be inside %s", dir)
+	}
+	return path, nil
+}
+
+// The state of the accept loop of a proxy, as shown and updated through the API.
+type acceptState struct {
+	Paused bool `json:"paused"`
+}
+
+func (server *ApiServer) AcceptShow(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(request)
+
+	proxy, err := server.Collection.Get(vars["proxy"])
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(acceptState{Paused: proxy.Paused()})
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = response.Write(data)
+	if err != nil {
+		logrus.Warn("AcceptShow: Failed to write response to client", err)
+	}
+}
+
+func (server *ApiServer) AcceptUpdate(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(request)
+
+	proxy, err := server.Collection.Get(vars["proxy"])
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// Default fields are the same as the existing state
+	input := acceptState{Paused: proxy.Paused()}
+	err = json.NewDecoder(request.Body).Decode(&input)
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if input.Paused {
+		proxy.Pause()
+	} else {
+		proxy.Resume()
+	}
+
+	data, err := json.Marshal(acceptState{Paused: proxy.Paused()})
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = response.Write(data)
+	if err != nil {
+		logrus.Warn("AcceptUpdate: Failed to write response to client", err)
+	}
+}
+
+func (server *ApiServer) ToxicTypeIndex(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+
+	data, err := json.Marshal(ToxicTypes())
+	if err != nil {
+		http.Error(response, server.apiError(err, http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = response.Write(data)
+	if err != nil {
+		logrus.Warn("ToxicTypeIndex: Failed to write response to client", err)
+	}
+}
+
+func (server *ApiServer) Version(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "text/plain")
 	_, err := response.Write([]byte(Version))
 	if err != nil {
@@ -320,11 +723,14 @@ func (server *server) Version(response http.ResponseWriter, request *http.Reques
 	}
 }
 
-func (server *server) apiError(err error, code int) string {
+func (server *ApiServer) apiError(err error, code int) string {
+	// Invalid toxics list each field error as well
+	fields, _ := err.(ValidationError)
 	data, err2 := json.Marshal(struct {
-		Title  string `json:"title"`
-		Status int    `json:"status"`
-	}{err.Error(), code})
+		Title  string       `json:"title"`
+		Status int          `json:"status"`
+		Errors []FieldError `json:"errors,omitempty"`
+	}{err.Error(), code, fields})
 	if err2 != nil {
 		logrus.Warn("Error json encoding error (╯°□°）╯︵ ┻━┻", err2)
 		return ""
@@ -334,10 +740,16 @@ func (server *server) apiError(err error, code int) string {
 
 func proxyWithToxics(proxy *Proxy) (result struct {
 	*Proxy
+	Rejected         int64            `json:"rejected"`
+	ResolveErrors    int64            `json:"resolve_errors"`
+	DialErrors       int64            `json:"dial_errors"`
 	UpstreamToxics   map[string]Toxic `json:"upstream_toxics"`
 	DownstreamToxics map[string]Toxic `json:"downstream_toxics"`
 }) {
 	result.Proxy = proxy
+	result.Rejected = proxy.Rejected()
+	result.ResolveErrors = proxy.ResolveErrors()
+	result.DialErrors = proxy.DialErrors()
 	result.UpstreamToxics = proxy.upToxics.GetToxicMap()
 	result.DownstreamToxics = proxy.downToxics.GetToxicMap()
 	return
@@ -1,15 +1,23 @@
-package main
+package toxiproxy
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	tclient "github.com/Shopify/toxiproxy/client"
 )
 
-var testServer *server
+var testServer *ApiServer
+
+var ctx = context.Background()
 
 var client = tclient.NewClient("http://127.0.0.1:8475")
 var testProxy = client.NewProxy(&tclient.Proxy{
@@ -23,7 +31,7 @@ func WithServer(t *testing.T, f func(string)) {
 	// Make sure only one server is running at a time. Apparently there's no clean
 	// way to shut it down between each test run.
 	if testServer == nil {
-		testServer = NewServer(NewProxyCollection())
+		testServer = NewServer()
 		go testServer.Listen("localhost", "8475")
 
 		// Allow server to start. There's no clean way to know when it listens.
@@ -32,7 +40,7 @@ func WithServer(t *testing.T, f func(string)) {
 
 	f("http://localhost:8475")
 
-	err := testServer.collection.Clear()
+	err := testServer.Collection.Clear()
 	if err != nil {
 		t.Error("Failed to clear collection", err)
 	}
@@ -41,7 +49,7 @@ func WithServer(t *testing.T, f func(string)) {
 func TestIndexWithNoProxies(t *testing.T) {
 	WithServer(t, func(addr string) {
 		client := tclient.NewClient(addr)
-		proxies, err := client.Proxies()
+		proxies, err := client.Proxies(ctx)
 		if err != nil {
 			t.Fatal("Failed getting proxies: ", err)
 		}
@@ -54,7 +62,7 @@ func TestIndexWithNoProxies(t *testing.T) {
 
 func TestCreateProxy(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Create()
+		err := testProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy: ", err)
 		}
@@ -64,7 +72,7 @@ func TestCreateProxy(t *testing.T) {
 func TestCreateProxyBlankName(t *testing.T) {
 	WithServer(t, func(addr string) {
 		blankProxy := client.NewProxy(&tclient.Proxy{})
-		err := blankProxy.Create()
+		err := blankProxy.Create(ctx)
 		if err == nil {
 			t.Fatal("Expected error creating proxy, got nil")
 		} else if err.Error() != "Create: HTTP 400: Missing required field: name" {
@@ -76,7 +84,7 @@ func TestCreateProxyBlankName(t *testing.T) {
 func TestCreateProxyBlankUpstream(t *testing.T) {
 	WithServer(t, func(addr string) {
 		blankProxy := client.NewProxy(&tclient.Proxy{Name: "test"})
-		err := blankProxy.Create()
+		err := blankProxy.Create(ctx)
 		if err == nil {
 			t.Fatal("Expected error creating proxy, got nil")
 		} else if err.Error() != "Create: HTTP 400: Missing required field: upstream" {
@@ -85,14 +93,26 @@ func TestCreateProxyBlankUpstream(t *testing.T) {
 	})
 }
 
+func TestCreateProxyUnknownMock(t *testing.T) {
+	WithServer(t, func(addr string) {
+		mockProxy := client.NewProxy(&tclient.Proxy{Name: "test", Upstream: "mock://nope"})
+		err := mockProxy.Create(ctx)
+		if err == nil {
+			t.Fatal("Expected error creating proxy, got nil")
+		} else if err.Error() != "Create: HTTP 400: Unknown mock upstream: nope" {
+			t.Fatal("Expected different error creating proxy:", err)
+		}
+	})
+}
+
 func TestIndexWithToxics(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Create()
+		err := testProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy")
 		}
 
-		proxies, err := client.Proxies()
+		proxies, err := client.Proxies(ctx)
 		if err != nil {
 			t.Fatal("Error listing proxies: ", err)
 		}
@@ -114,12 +134,12 @@ func TestIndexWithToxics(t *testing.T) {
 
 func TestGetProxy(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Create()
+		err := testProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy")
 		}
 
-		proxy, err := client.Proxy("mysql_master")
+		proxy, err := client.Proxy(ctx, "mysql_master")
 		if err != nil {
 			t.Fatal("Unable to retriecve proxy: ", err)
 		}
@@ -138,12 +158,12 @@ func TestCreateDisabledProxy(t *testing.T) {
 		disabledProxy := *testProxy
 		disabledProxy.Enabled = false
 
-		err := disabledProxy.Create()
+		err := disabledProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy: ", err)
 		}
 
-		proxy, err := client.Proxy("mysql_master")
+		proxy, err := client.Proxy(ctx, "mysql_master")
 		if err != nil {
 			t.Fatal("Unable to retriecve proxy: ", err)
 		}
@@ -161,12 +181,12 @@ func TestCreateDisabledProxyAndEnable(t *testing.T) {
 		disabledProxy := *testProxy
 		disabledProxy.Enabled = false
 
-		err := disabledProxy.Create()
+		err := disabledProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy: ", err)
 		}
 
-		proxy, err := client.Proxy("mysql_master")
+		proxy, err := client.Proxy(ctx, "mysql_master")
 		if err != nil {
 			t.Fatal("Unable to retriecve proxy: ", err)
 		}
@@ -177,7 +197,7 @@ func TestCreateDisabledProxyAndEnable(t *testing.T) {
 
 		proxy.Enabled = true
 
-		err = proxy.Save()
+		err = proxy.Save(ctx)
 		if err != nil {
 			t.Fatal("Failed to update proxy: ", err)
 		}
@@ -186,7 +206,7 @@ func TestCreateDisabledProxyAndEnable(t *testing.T) {
 
 		proxy.Enabled = false
 
-		err = proxy.Save()
+		err = proxy.Save(ctx)
 		if err != nil {
 			t.Fatal("Failed to update proxy: ", err)
 		}
@@ -197,12 +217,12 @@ func TestCreateDisabledProxyAndEnable(t *testing.T) {
 
 func TestDeleteProxy(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Create()
+		err := testProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy: ", err)
 		}
 
-		proxies, err := client.Proxies()
+		proxies, err := client.Proxies(ctx)
 		if err != nil {
 			t.Fatal("Error listing proxies: ", err)
 		}
@@ -213,14 +233,14 @@ func TestDeleteProxy(t *testing.T) {
 
 		AssertProxyUp(t, testProxy.Listen, true)
 
-		err = testProxy.Delete()
+		err = testProxy.Delete(ctx)
 		if err != nil {
 			t.Fatal("Failed deleting proxy: ", err)
 		}
 
 		AssertProxyUp(t, testProxy.Listen, false)
 
-		proxies, err = client.Proxies()
+		proxies, err = client.Proxies(ctx)
 		if err != nil {
 			t.Fatal("Error listing proxies: ", err)
 		}
@@ -233,25 +253,25 @@ func TestDeleteProxy(t *testing.T) {
 
 func TestCreateProxyPortConflict(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Create()
+		err := testProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy")
 		}
 
 		testProxy2 := *testProxy
 		testProxy2.Name = "test"
-		err = testProxy2.Create()
+		err = testProxy2.Create(ctx)
 		if err == nil {
 			t.Fatal("Proxy did not result in conflict.")
 		} else if err.Error() != "Create: HTTP 409: listen tcp 127.0.0.1:3310: bind: address already in use" {
 			t.Fatal("Incorrect error adding proxy:", err)
 		}
 
-		err = testProxy.Delete()
+		err = testProxy.Delete(ctx)
 		if err != nil {
 			t.Fatal("Unable to delete proxy: ", err)
 		}
-		err = testProxy2.Create()
+		err = testProxy2.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy: ", err)
 		}
@@ -260,25 +280,25 @@ func TestCreateProxyPortConflict(t *testing.T) {
 
 func TestCreateProxyNameConflict(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Create()
+		err := testProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy: ", err)
 		}
 
 		testProxy2 := *testProxy
 		testProxy2.Listen = "localhost:3311"
-		err = testProxy2.Create()
+		err = testProxy2.Create(ctx)
 		if err == nil {
 			t.Fatal("Proxy did not result in conflict.")
 		} else if err.Error() != "Create: HTTP 409: Proxy with name mysql_master already exists" {
 			t.Fatal("Incorrect error adding proxy:", err)
 		}
 
-		err = testProxy.Delete()
+		err = testProxy.Delete(ctx)
 		if err != nil {
 			t.Fatal("Unable to delete proxy: ", err)
 		}
-		err = testProxy2.Create()
+		err = testProxy2.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy: ", err)
 		}
@@ -287,7 +307,7 @@ func TestCreateProxyNameConflict(t *testing.T) {
 
 func TestDeleteNonExistantProxy(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Delete()
+		err := testProxy.Delete(ctx)
 		if err == nil {
 			t.Fatal("Expected error when deleting proxy that doesn't exist")
 		}
@@ -299,12 +319,12 @@ func TestResetState(t *testing.T) {
 		disabledProxy := *testProxy
 		disabledProxy.Enabled = false
 
-		err := disabledProxy.Create()
+		err := disabledProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy: ", err)
 		}
 
-		latency, err := disabledProxy.SetToxic("latency", "downstream", tclient.Toxic{
+		latency, err := disabledProxy.SetToxic(ctx, "latency", "downstream", tclient.Toxic{
 			"enabled": true,
 			"latency": 100,
 			"jitter":  10,
@@ -320,12 +340,12 @@ func TestResetState(t *testing.T) {
 			t.Fatal("Latency toxic did not start up with correct settings")
 		}
 
-		err = client.ResetState()
+		err = client.ResetState(ctx)
 		if err != nil {
 			t.Fatal("unable to reset state: ", err)
 		}
 
-		proxies, err := client.Proxies()
+		proxies, err := client.Proxies(ctx)
 		if err != nil {
 			t.Fatal("Error listing proxies: ", err)
 		}
@@ -338,7 +358,7 @@ func TestResetState(t *testing.T) {
 			t.Fatal("Expected proxy to be enabled")
 		}
 
-		toxics, err := proxy.Toxics("downstream")
+		toxics, err := proxy.Toxics(ctx, "downstream")
 		if err != nil {
 			t.Fatal("Error requesting toxics: %+v", err)
 		}
@@ -354,12 +374,12 @@ func TestResetState(t *testing.T) {
 
 func TestListingToxics(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Create()
+		err := testProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy")
 		}
 
-		toxics, err := testProxy.Toxics("upstream")
+		toxics, err := testProxy.Toxics(ctx, "upstream")
 		if err != nil {
 			t.Fatal("Error returning toxics: %+v", err)
 		}
@@ -370,12 +390,12 @@ func TestListingToxics(t *testing.T) {
 
 func TestSetToxics(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Create()
+		err := testProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy")
 		}
 
-		latency, err := testProxy.SetToxic("latency", "downstream", tclient.Toxic{
+		latency, err := testProxy.SetToxic(ctx, "latency", "downstream", tclient.Toxic{
 			"enabled": true,
 			"latency": 100,
 			"jitter":  10,
@@ -391,13 +411,13 @@ func TestSetToxics(t *testing.T) {
 			t.Fatal("Latency toxic did not start up with correct settings")
 		}
 
-		toxics, err := testProxy.Toxics("downstream")
+		toxics, err := testProxy.Toxics(ctx, "downstream")
 		if err != nil {
 			t.Fatal("Error returning toxics: %+v", err)
 		}
 		AssertToxicEnabled(t, toxics, "latency", true)
 
-		toxics, err = testProxy.Toxics("upstream")
+		toxics, err = testProxy.Toxics(ctx, "upstream")
 		if err != nil {
 			t.Fatal("Error returning toxics: %+v", err)
 		}
@@ -407,12 +427,12 @@ func TestSetToxics(t *testing.T) {
 
 func TestUpdateToxics(t *testing.T) {
 	WithServer(t, func(addr string) {
-		err := testProxy.Create()
+		err := testProxy.Create(ctx)
 		if err != nil {
 			t.Fatal("Unable to create proxy: ", err)
 		}
 
-		latency, err := testProxy.SetToxic("latency", "downstream", tclient.Toxic{
+		latency, err := testProxy.SetToxic(ctx, "latency", "downstream", tclient.Toxic{
 			"enabled": true,
 			"latency": 100,
 			"jitter":  10,
@@ -428,7 +448,7 @@ func TestUpdateToxics(t *testing.T) {
 			t.Fatal("Latency toxic did not start up with correct settings: %+v", latency)
 		}
 
-		latency, err = testProxy.SetToxic("latency", "downstream", tclient.Toxic{
+		latency, err = testProxy.SetToxic(ctx, "latency", "downstream", tclient.Toxic{
 			"latency": 1000,
 		})
 		if err != nil {
@@ -444,6 +464,310 @@ func TestUpdateToxics(t *testing.T) {
 	})
 }
 
+func TestRecordProxy(t *testing.T) {
+	WithServer(t, func(addr string) {
+		err := testProxy.Create(ctx)
+		if err != nil {
+			t.Fatal("Unable to create proxy: ", err)
+		}
+
+		_, err = testProxy.SetRecording(ctx, tclient.Recording{Enabled: true})
+		if err == nil {
+			t.Fatal("Expected error starting recording without a path")
+		} else if err.Error() != "SetRecording: HTTP 400: Missing required field: path" {
+			t.Fatal("Expected different error starting recording:", err)
+		}
+
+		dir, err := ioutil.TempDir("", "toxiproxy")
+		if err != nil {
+			t.Fatal("Failed to create temporary directory", err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "capture.pcapng")
+
+		_, err = testProxy.SetRecording(ctx, tclient.Recording{Enabled: true, Path: path})
+		if err == nil || !strings.Contains(err.Error(), "Recording is disabled") {
+			t.Fatal("Expected recording to be refused without a record directory:", err)
+		}
+
+		testServer.RecordDir = dir
+		defer func() { testServer.RecordDir = "" }()
+		for _, outside := range []string{"../capture.pcapng", "/etc/capture.pcapng"} {
+			_, err = testProxy.SetRecording(ctx, tclient.Recording{Enabled: true, Path: outside})
+			if err == nil || !strings.Contains(err.Error(), "Invalid path") {
+				t.Fatalf("Expected recording to %s to be refused: %v", outside, err)
+			}
+		}
+
+		// Relative paths are inside the record directory
+		recording, err := testProxy.SetRecording(ctx, tclient.Recording{Enabled: true, Path: "capture.pcapng"})
+		if err != nil {
+			t.Fatal("Failed to start recording: ", err)
+		}
+		if !recording.Enabled || recording.Path != path {
+			t.Fatalf("Unexpected recording state: %v, %s", recording.Enabled, recording.Path)
+		}
+
+		recording, err = testProxy.SetRecording(ctx, tclient.Recording{Enabled: false})
+		if err != nil {
+			t.Fatal("Failed to stop recording: ", err)
+		}
+
+		recording, err = testProxy.Recording(ctx)
+		if err != nil {
+			t.Fatal("Failed to get recording: ", err)
+		}
+		if recording.Enabled {
+			t.Fatal("Expected recording to be stopped")
+		}
+
+		blocks := ReadPcapngBlocks(t, path)
+		if len(blocks) != 2 {
+			t.Fatalf("Expected only capture headers to be written, got %d blocks", len(blocks))
+		}
+	})
+}
+
+func TestApiErrorStatus(t *testing.T) {
+	WithServer(t, func(addr string) {
+		_, err := client.Proxy(ctx, "missing")
+		var apiError *tclient.ApiError
+		if !errors.As(err, &apiError) || apiError.Status != http.StatusNotFound {
+			t.Fatal("Expected missing proxy to return a 404 ApiError:", err)
+		}
+
+		err = testProxy.Create(ctx)
+		if err != nil {
+			t.Fatal("Unable to create proxy: ", err)
+		}
+		err = testProxy.Create(ctx)
+		if !errors.As(err, &apiError) || apiError.Status != http.StatusConflict {
+			t.Fatal("Expected duplicate proxy to return a 409 ApiError:", err)
+		}
+	})
+}
+
+func TestClientOptions(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	hung := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requests <- request
+		<-request.Context().Done()
+	}))
+	defer hung.Close()
+
+	client := tclient.NewClient(hung.URL,
+		tclient.WithHTTPClient(&http.Client{}),
+		tclient.WithTimeout(50*time.Millisecond),
+		tclient.WithBasePath("/toxiproxy"),
+		tclient.WithToken("secret"),
+		tclient.WithUserAgent("toxiproxy-test"),
+	)
+
+	start := time.Now()
+	_, err := client.Proxies(ctx)
+	if err == nil {
+		t.Fatal("Expected request to a hung server to time out")
+	}
+	AssertDeltaTime(t, "Client timeout", time.Since(start), 50*time.Millisecond, 50*time.Millisecond)
+
+	request := <-requests
+	if request.URL.Path != "/toxiproxy/proxies" {
+		t.Error("Request did not use base path:", request.URL.Path)
+	}
+	if request.Header.Get("Authorization") != "Bearer secret" {
+		t.Error("Request did not include token:", request.Header.Get("Authorization"))
+	}
+	if request.Header.Get("User-Agent") != "toxiproxy-test" {
+		t.Error("Request did not include user agent:", request.Header.Get("User-Agent"))
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = client.ResetState(cancelled)
+	if !errors.Is(err, context.Canceled) {
+		t.Error("Expected cancelled context to abort request:", err)
+	}
+}
+
+func TestTypedToxics(t *testing.T) {
+	WithServer(t, func(addr string) {
+		err := testProxy.Create(ctx)
+		if err != nil {
+			t.Fatal("Unable to create proxy: ", err)
+		}
+
+		latency, err := testProxy.AddLatency(ctx, tclient.Upstream, 100*time.Millisecond, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal("Error adding latency: ", err)
+		}
+		if !latency.Enabled || latency.Latency != 100 || latency.Jitter != 10 {
+			t.Fatalf("Latency toxic did not start up with correct settings: %+v", latency)
+		}
+
+		empirical := &tclient.LatencyToxic{
+			Enabled:      true,
+			Distribution: "empirical",
+			Correlation:  25,
+			Histogram:    []tclient.HistogramBucket{{Latency: 10, Weight: 1}, {Latency: 100, Weight: 2}},
+		}
+		err = testProxy.SetTypedToxic(ctx, tclient.Downstream, empirical)
+		if err != nil {
+			t.Fatal("Error setting empirical latency: ", err)
+		}
+		if empirical.Correlation != 25 || len(empirical.Histogram) != 2 || empirical.Histogram[1].Weight != 2 {
+			t.Fatalf("Latency toxic did not start up with correct settings: %+v", empirical)
+		}
+
+		slicer, err := testProxy.AddSlicer(ctx, tclient.Downstream, 1024, 128, 10*time.Microsecond)
+		if err != nil {
+			t.Fatal("Error adding slicer: ", err)
+		}
+		if !slicer.Enabled || slicer.AverageSize != 1024 || slicer.SizeVariation != 128 || slicer.Delay != 10 {
+			t.Fatalf("Slicer toxic did not start up with correct settings: %+v", slicer)
+		}
+
+		toxics, err := testProxy.Toxics(ctx, tclient.Upstream)
+		if err != nil {
+			t.Fatal("Error returning toxics: ", err)
+		}
+		AssertToxicEnabled(t, toxics, "latency", true)
+
+		err = testProxy.RemoveToxic(ctx, tclient.Upstream, "latency")
+		if err != nil {
+			t.Fatal("Error removing latency: ", err)
+		}
+		toxics, err = testProxy.Toxics(ctx, tclient.Upstream)
+		if err != nil {
+			t.Fatal("Error returning toxics: ", err)
+		}
+		AssertToxicEnabled(t, toxics, "latency", false)
+	})
+}
+
+func TestSetToxicUnknownField(t *testing.T) {
+	WithServer(t, func(addr string) {
+		err := testProxy.Create(ctx)
+		if err != nil {
+			t.Fatal("Unable to create proxy: ", err)
+		}
+
+		_, err = testProxy.SetToxic(ctx, "latency", "downstream", tclient.Toxic{
+			"latnecy": 100,
+		})
+		if err == nil {
+			t.Fatal("Expected error setting toxic with unknown field")
+		} else if err.Error() != `SetToxic: HTTP 400: json: unknown field "latnecy"` {
+			t.Fatal("Expected different error setting toxic:", err)
+		}
+	})
+}
+
+func TestSetInvalidToxic(t *testing.T) {
+	WithServer(t, func(addr string) {
+		err := testProxy.Create(ctx)
+		if err != nil {
+			t.Fatal("Unable to create proxy: ", err)
+		}
+
+		_, err = testProxy.SetToxic(ctx, "latency", "downstream", tclient.Toxic{
+			"enabled": true,
+			"latency": -100,
+			"jitter":  10,
+		})
+		var apiError *tclient.ApiError
+		if !errors.As(err, &apiError) {
+			t.Fatal("Expected API error setting invalid toxic:", err)
+		}
+		if apiError.Status != http.StatusBadRequest || apiError.Title != "Invalid toxic: latency must not be negative" {
+			t.Fatalf("Expected different error setting invalid toxic: %+v", apiError)
+		}
+		if len(apiError.Errors) != 1 || apiError.Errors[0].Field != "latency" {
+			t.Fatalf("Expected latency field error, got %+v", apiError.Errors)
+		}
+
+		toxics, err := testProxy.Toxics(ctx, "downstream")
+		if err != nil {
+			t.Fatal("Error returning toxics: ", err)
+		}
+		AssertToxicEnabled(t, toxics, "latency", false)
+		if toxics["latency"]["jitter"] != 0.0 {
+			t.Fatal("Invalid request should not have changed the toxic:", toxics["latency"])
+		}
+	})
+}
+
+func TestSetDatagramToxicOnStreamProxy(t *testing.T) {
+	WithServer(t, func(addr string) {
+		err := testProxy.Create(ctx)
+		if err != nil {
+			t.Fatal("Unable to create proxy: ", err)
+		}
+
+		_, err = testProxy.SetToxic(ctx, "reorder", "downstream", tclient.Toxic{"enabled": true, "probability": 10})
+		var apiError *tclient.ApiError
+		if !errors.As(err, &apiError) {
+			t.Fatal("Expected API error enabling reorder on a TCP proxy:", err)
+		}
+		if len(apiError.Errors) != 1 || apiError.Errors[0].Field != "enabled" {
+			t.Fatalf("Expected enabled field error, got %+v", apiError.Errors)
+		}
+
+		// Datagram toxics can still be configured while disabled
+		_, err = testProxy.SetToxic(ctx, "duplicate", "downstream", tclient.Toxic{"probability": 10})
+		if err != nil {
+			t.Fatal("Error setting disabled duplicate toxic: ", err)
+		}
+	})
+}
+
+func TestSetDNSToxicDownstream(t *testing.T) {
+	WithServer(t, func(addr string) {
+		err := testProxy.Create(ctx)
+		if err != nil {
+			t.Fatal("Unable to create proxy: ", err)
+		}
+
+		_, err = testProxy.SetToxic(ctx, "dns", "downstream", tclient.Toxic{"enabled": true, "mode": "servfail"})
+		var apiError *tclient.ApiError
+		if !errors.As(err, &apiError) {
+			t.Fatal("Expected API error enabling dns downstream:", err)
+		}
+		if len(apiError.Errors) != 1 || apiError.Errors[0].Field != "enabled" {
+			t.Fatalf("Expected enabled field error, got %+v", apiError.Errors)
+		}
+
+		toxic, err := testProxy.SetToxic(ctx, "dns", "upstream", tclient.Toxic{"enabled": true, "mode": "servfail", "probability": 50})
+		if err != nil {
+			t.Fatal("Error setting dns toxic: ", err)
+		}
+		if toxic["mode"] != "servfail" || toxic["probability"] != 50.0 || toxic["address"] != "192.0.2.1" {
+			t.Fatal("Unexpected dns toxic: ", toxic)
+		}
+	})
+}
+
+func TestToxicTypes(t *testing.T) {
+	WithServer(t, func(addr string) {
+		types, err := client.ToxicTypes(ctx)
+		if err != nil {
+			t.Fatal("Error listing toxic types: ", err)
+		}
+
+		if len(types) == 0 || types[0].Name != "slow_close" {
+			t.Fatalf("Expected toxic types in chain order, got %+v", types)
+		}
+		for _, toxicType := range types {
+			if toxicType.Name == "slicer" {
+				if len(toxicType.Fields) != 4 || toxicType.Fields[1].Name != "average_size" || toxicType.Fields[1].Type != "integer" {
+					t.Fatalf("Unexpected slicer fields: %+v", toxicType.Fields)
+				}
+				return
+			}
+		}
+		t.Fatal("Expected slicer toxic type")
+	})
+}
+
 func TestVersionEndpointReturnsVersion(t *testing.T) {
 	WithServer(t, func(addr string) {
 		resp, err := http.Get(addr + "/version")
@@ -474,3 +798,91 @@ func AssertToxicEnabled(t *testing.T, toxics tclient.Toxics, name string, enable
 	}
 	return toxic
 }
+
+func TestPauseAccept(t *testing.T) {
+	WithServer(t, func(addr string) {
+		err := testProxy.Create(ctx)
+		if err != nil {
+			t.Fatal("Unable to create proxy: ", err)
+		}
+
+		err = testProxy.PauseAccept(ctx)
+		if err != nil {
+			t.Fatal("Failed to pause proxy: ", err)
+		}
+		paused, err := testProxy.AcceptPaused(ctx)
+		if err != nil {
+			t.Fatal("Failed to get accept state: ", err)
+		}
+		if !paused {
+			t.Fatal("Expected proxy to be paused")
+		}
+
+		err = client.ResetState(ctx)
+		if err != nil {
+			t.Fatal("Failed to reset state: ", err)
+		}
+		paused, err = testProxy.AcceptPaused(ctx)
+		if err != nil {
+			t.Fatal("Failed to get accept state: ", err)
+		}
+		if paused {
+			t.Fatal("Expected reset to resume the proxy")
+		}
+	})
+}
+
+func TestFrontendRules(t *testing.T) {
+	WithServer(t, func(addr string) {
+		frontend := client.NewProxy(&tclient.Proxy{
+			Name:     "frontend",
+			Listen:   "localhost:0",
+			Enabled:  true,
+			Frontend: "connect",
+			Rules:    []tclient.Rule{{Name: "db", Host: "*.internal", Port: "5432"}},
+		})
+		err := frontend.Create(ctx)
+		if err != nil {
+			t.Fatal("Unable to create proxy: ", err)
+		}
+		if frontend.Upstream != "" || len(frontend.Rules) != 1 || frontend.Rules[0].Host != "*.internal" {
+			t.Fatalf("Unexpected proxy: %+v", frontend)
+		}
+
+		_, err = frontend.SetRuleToxic(ctx, "db", "latency", "downstream", tclient.Toxic{"enabled": true, "latency": 100})
+		if err != nil {
+			t.Fatal("Error setting rule toxic: ", err)
+		}
+		toxics, err := frontend.RuleToxics(ctx, "db", "downstream")
+		if err != nil {
+			t.Fatal("Error getting rule toxics: ", err)
+		}
+		if toxics["latency"]["enabled"] != true || toxics["latency"]["latency"] != 100.0 {
+			t.Fatal("Unexpected rule toxics: ", toxics["latency"])
+		}
+		if toxics, _ := frontend.Toxics(ctx, "downstream"); toxics["latency"]["enabled"] != false {
+			t.Fatal("Expected proxy toxics not to change")
+		}
+
+		_, err = frontend.RuleToxics(ctx, "missing", "upstream")
+		var apiError *tclient.ApiError
+		if !errors.As(err, &apiError) || apiError.Status != http.StatusNotFound {
+			t.Fatal("Expected not found error for missing rule:", err)
+		}
+
+		frontend.Frontend = "socks4"
+		err = frontend.Save(ctx)
+		if err == nil || !strings.Contains(err.Error(), "Invalid frontend: socks4") {
+			t.Fatal("Expected invalid frontend error:", err)
+		}
+
+		err = client.ResetState(ctx)
+		if err != nil {
+			t.Fatal("Failed to reset state: ", err)
+		}
+		toxics, err = frontend.RuleToxics(ctx, "db", "downstream")
+		if err != nil || toxics["latency"]["enabled"] != false {
+			t.Fatal("Expected reset to disable rule toxics:", err)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package toxiproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Tokens in the API token file have a scope, which determines which requests
+// they can make. Read tokens can only make requests which don't modify state.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// An APIToken is a static bearer token allowing access to the HTTP API.
+type APIToken struct {
+	Token string `json:"token"`
+	Scope string `json:"scope"`
+}
+
+var (
+	ErrMissingToken      = errors.New("Missing API token")
+	ErrInvalidToken      = errors.New("Invalid API token")
+	ErrInsufficientScope = errors.New("API token does not allow this request")
+	ErrNoTokens          = errors.New("No API tokens in file")
+)
+
+// LoadTokens reads a JSON file containing a list of API tokens, e.g.:
+//
+//     [{"token": "secret", "scope": "write"}]
+//
+func LoadTokens(path string) ([]APIToken, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []APIToken
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	// A file containing null or [] would lock everyone out, or be mistaken for
+	// no authentication
+	if len(tokens) < 1 {
+		return nil, ErrNoTokens
+	}
+
+	for _, token := range tokens {
+		if len(token.Token) < 1 {
+			return nil, errors.New("Missing required field: token")
+		}
+		if token.Scope != ScopeRead && token.Scope != ScopeWrite {
+			return nil, fmt.Errorf("Invalid token scope: %s", token.Scope)
+		}
+	}
+	return tokens, nil
+}
+
+// authenticate wraps the API handler, rejecting requests without a valid token
+// for their scope. Authentication is disabled unless RequireTokens is set.
+func (server *ApiServer) authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !server.RequireTokens {
+			handler.ServeHTTP(response, request)
+			return
+		}
+
+		scope, err := server.tokenScope(request)
+		if err != nil {
+			response.Header().Set("Content-Type", "application/json")
+			response.Header().Set("WWW-Authenticate", `Bearer realm="toxiproxy"`)
+			http.Error(response, server.apiError(err, http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if scope != ScopeWrite && requiredScope(request) == ScopeWrite {
+			response.Header().Set("Content-Type", "application/json")
+			http.Error(response, server.apiError(ErrInsufficientScope, http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(response, request)
+	})
+}
+
+// Returns the scope of the bearer token in the request's Authorization header.
+func (server *ApiServer) tokenScope(request *http.Request) (string, error) {
+	header := request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", ErrMissingToken
+	}
+	token := []byte(strings.TrimPrefix(header, "Bearer "))
+
+	for _, t := range server.Tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+			return t.Scope, nil
+		}
+	}
+	return "", ErrInvalidToken
+}
+
+// Returns the scope needed to make a request. Only reads are allowed with the
+// read scope, and /reset modifies state even though it's a GET.
+func requiredScope(request *http.Request) string {
+	if (request.Method == "GET" || request.Method == "HEAD") && request.URL.Path != "/reset" {
+		return ScopeRead
+	}
+	return ScopeWrite
+}
@@ -0,0 +1,143 @@
+package toxiproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tclient "github.com/Shopify/toxiproxy/client"
+)
+
+func WithAuthenticatedServer(t *testing.T, f func(string)) {
+	server := NewServer()
+	server.RequireTokens = true
+	server.Tokens = []APIToken{
+		{Token: "read-token", Scope: ScopeRead},
+		{Token: "write-token", Scope: ScopeWrite},
+	}
+
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	f(httpServer.URL)
+
+	server.Collection.Clear()
+}
+
+func TestLoadTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "toxiproxy")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	ioutil.WriteFile(path, []byte(`[{"token": "a", "scope": "read"}, {"token": "b", "scope": "write"}]`), 0644)
+	tokens, err := LoadTokens(path)
+	if err != nil {
+		t.Fatal("Failed to load tokens", err)
+	}
+	if len(tokens) != 2 || tokens[0].Scope != ScopeRead || tokens[1].Token != "b" {
+		t.Fatalf("Loaded unexpected tokens: %+v", tokens)
+	}
+
+	ioutil.WriteFile(path, []byte(`[{"token": "a", "scope": "admin"}]`), 0644)
+	_, err = LoadTokens(path)
+	if err == nil || err.Error() != "Invalid token scope: admin" {
+		t.Fatal("Expected invalid scope to be rejected", err)
+	}
+
+	for _, empty := range []string{"null", "[]"} {
+		ioutil.WriteFile(path, []byte(empty), 0644)
+		_, err = LoadTokens(path)
+		if err != ErrNoTokens {
+			t.Fatalf("Expected %s to be rejected, got %v", empty, err)
+		}
+	}
+}
+
+func TestAuthenticationWithoutTokens(t *testing.T) {
+	server := NewServer()
+	server.RequireTokens = true
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	// Requiring tokens without any fails closed
+	client := tclient.NewClient(httpServer.URL, tclient.WithToken("any-token"))
+	_, err := client.Proxies(ctx)
+	if err == nil || err.Error() != "Proxies: HTTP 401: Invalid API token" {
+		t.Fatal("Expected request to be unauthorized:", err)
+	}
+}
+
+func TestAuthenticationRequired(t *testing.T) {
+	WithAuthenticatedServer(t, func(addr string) {
+		client := tclient.NewClient(addr)
+		_, err := client.Proxies(ctx)
+		if err == nil || err.Error() != "Proxies: HTTP 401: Missing API token" {
+			t.Fatal("Expected request without token to be unauthorized:", err)
+		}
+
+		client = tclient.NewClient(addr, tclient.WithToken("wrong-token"))
+		_, err = client.Proxies(ctx)
+		if err == nil || err.Error() != "Proxies: HTTP 401: Invalid API token" {
+			t.Fatal("Expected request with invalid token to be unauthorized:", err)
+		}
+	})
+}
+
+func TestReadTokenScope(t *testing.T) {
+	WithAuthenticatedServer(t, func(addr string) {
+		client := tclient.NewClient(addr, tclient.WithToken("read-token"))
+
+		_, err := client.Proxies(ctx)
+		if err != nil {
+			t.Fatal("Expected read token to list proxies:", err)
+		}
+
+		proxy := client.NewProxy(&tclient.Proxy{Name: "test", Upstream: "mock://echo", Listen: "localhost:0"})
+		err = proxy.Create(ctx)
+		if err == nil || err.Error() != "Create: HTTP 403: API token does not allow this request" {
+			t.Fatal("Expected read token to be forbidden from creating proxies:", err)
+		}
+
+		err = client.ResetState(ctx)
+		if err == nil || err.Error() != "ResetState: HTTP 403: API token does not allow this request" {
+			t.Fatal("Expected read token to be forbidden from resetting state:", err)
+		}
+	})
+}
+
+func TestWriteTokenScope(t *testing.T) {
+	WithAuthenticatedServer(t, func(addr string) {
+		client := tclient.NewClient(addr, tclient.WithToken("write-token"))
+
+		proxy := client.NewProxy(&tclient.Proxy{Name: "test", Upstream: "mock://echo", Listen: "localhost:0", Enabled: true})
+		err := proxy.Create(ctx)
+		if err != nil {
+			t.Fatal("Expected write token to create proxies:", err)
+		}
+
+		err = proxy.Delete(ctx)
+		if err != nil {
+			t.Fatal("Expected write token to delete proxies:", err)
+		}
+	})
+}
+
+func TestUnauthenticatedHeader(t *testing.T) {
+	WithAuthenticatedServer(t, func(addr string) {
+		resp, err := http.Get(addr + "/version")
+		if err != nil {
+			t.Fatal("Failed to get version", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("Expected unauthorized response with challenge, got %d", resp.StatusCode)
+		}
+	})
+}
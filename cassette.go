@@ -0,0 +1,330 @@
+package toxiproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// A Cassette stores the data exchanged with an upstream so it can be served
+// again later without the upstream. When a proxy is recording, every
+// connection to the upstream is saved as a session in the cassette. When the
+// proxy is replaying, connections are served from a recorded session instead
+// of dialing the upstream. In both cases the data still goes through the
+// toxics like any other upstream.
+//
+// Client <-> toxiproxy <-> Cassette (<-> Upstream)
+//
+// The cassette file holds one session per line, as JSON, so sessions are
+// appended to it as they're recorded.
+type Cassette struct {
+	sync.Mutex
+
+	// The sessions to replay
+	Sessions []*CassetteSession
+
+	path  string
+	match string
+	next  int
+	// The file sessions are appended to while recording
+	file *os.File
+}
+
+// A CassetteSession is the recording of a single connection to the upstream.
+type CassetteSession struct {
+	Events []CassetteEvent `json:"events"`
+	// Which side closed the connection first, "client" or "upstream"
+	ClosedBy string `json:"closed_by"`
+}
+
+// A CassetteEvent is a chunk of data sent in a direction, "upstream" for data
+// sent by the client and "downstream" for data sent by the upstream.
+type CassetteEvent struct {
+	Direction string `json:"direction"`
+	Data      []byte `json:"data"`
+}
+
+const (
+	CassetteModeRecord = "record"
+	CassetteModeReplay = "replay"
+
+	CassetteMatchOrder  = "order"
+	CassetteMatchPrefix = "prefix"
+)
+
+var ErrCassetteExhausted = errors.New("No recorded sessions left in cassette")
+var ErrCassetteClosed = errors.New("Cassette is closed")
+
+// Validates the cassette fields of a proxy.
+func validateCassette(proxy *Proxy) error {
+	switch proxy.CassetteMode {
+	case "":
+		return nil
+	case CassetteModeRecord, CassetteModeReplay:
+	default:
+		return fmt.Errorf("Invalid cassette mode: %s", proxy.CassetteMode)
+	}
+	if len(proxy.Cassette) < 1 {
+		return errors.New("Missing required field: cassette")
+	}
+	switch proxy.CassetteMatch {
+	case "", CassetteMatchOrder, CassetteMatchPrefix:
+	default:
+		return fmt.Errorf("Invalid cassette match: %s", proxy.CassetteMatch)
+	}
+	return nil
+}
+
+// OpenCassette opens the cassette at path for recording, creating it if it
+// doesn't exist. New sessions are added after those already in the file, so
+// restarting a recording proxy keeps what it recorded so far.
+func OpenCassette(path string) (*Cassette, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Cassette{path: path, file: file}, nil
+}
+
+// LoadCassette reads a recorded cassette for replaying. Sessions are matched to
+// new connections by their order, or by the first bytes sent by the client.
+func LoadCassette(path string, match string) (*Cassette, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cassette := &Cassette{path: path, match: match}
+	decoder := json.NewDecoder(file)
+	for {
+		session := new(CassetteSession)
+		err = decoder.Decode(session)
+		if err == io.EOF {
+			return cassette, nil
+		} else if err != nil {
+			return nil, err
+		}
+		cassette.Sessions = append(cassette.Sessions, session)
+	}
+}
+
+// Close stops recording to the cassette. Sessions closed afterwards are lost.
+func (c *Cassette) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// Appends the session to the cassette file, on a line of its own.
+func (c *Cassette) addSession(session *CassetteSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.file == nil {
+		return ErrCassetteClosed
+	}
+	_, err = c.file.Write(append(data, '\n'))
+	return err
+}
+
+// Record wraps a connection to the upstream, saving a new session to the
+// cassette when it is closed.
+func (c *Cassette) Record(upstream net.Conn) net.Conn {
+	return &recordingConn{
+		Conn:     upstream,
+		cassette: c,
+		session:  &CassetteSession{Events: []CassetteEvent{}},
+	}
+}
+
+// Replay returns a connection serving a recorded session. When matching by
+// order the next session is used, otherwise the session is chosen once the
+// client has sent its first bytes.
+func (c *Cassette) Replay() (net.Conn, error) {
+	var session *CassetteSession
+	if c.match != CassetteMatchPrefix {
+		c.Lock()
+		if c.next >= len(c.Sessions) {
+			c.Unlock()
+			return nil, ErrCassetteExhausted
+		}
+		session = c.Sessions[c.next]
+		c.next++
+		c.Unlock()
+	}
+
+	local, remote := halfClosePipe()
+	go c.play(session, remote)
+	return local, nil
+}
+
+// Plays back a session on one end of a pipe. A nil session is matched using
+// the first read from the client.
+func (c *Cassette) play(session *CassetteSession, conn net.Conn) {
+	defer conn.Close()
+
+	var input io.Reader = conn
+	if session == nil {
+		buf := make([]byte, 32*1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		session = c.matchPrefix(buf[:n])
+		if session == nil {
+			logrus.WithFields(logrus.Fields{
+				"cassette": c.path,
+			}).Warn("No recorded session matches client")
+			return
+		}
+		input = io.MultiReader(bytes.NewReader(buf[:n]), conn)
+	}
+
+	for _, event := range session.Events {
+		var err error
+		if event.Direction == "upstream" {
+			// The data sent by the client isn't compared to the recording
+			_, err = io.CopyN(ioutil.Discard, input, int64(len(event.Data)))
+		} else {
+			_, err = conn.Write(event.Data)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if session.ClosedBy != "upstream" {
+		// Wait for the client to close the connection
+		io.Copy(ioutil.Discard, input)
+	}
+}
+
+// Returns the session with the longest common prefix between the client data
+// and the first data it recorded from the client.
+func (c *Cassette) matchPrefix(data []byte) *CassetteSession {
+	c.Lock()
+	defer c.Unlock()
+
+	var best *CassetteSession
+	bestLength := 0
+	for _, session := range c.Sessions {
+		for _, event := range session.Events {
+			if event.Direction != "upstream" {
+				continue
+			}
+			length := 0
+			for length < len(data) && length < len(event.Data) && data[length] == event.Data[length] {
+				length++
+			}
+			if length > bestLength {
+				best = session
+				bestLength = length
+			}
+			break
+		}
+	}
+	return best
+}
+
+// A recordingConn saves the data sent through a connection to the upstream.
+type recordingConn struct {
+	net.Conn
+
+	lock     sync.Mutex
+	cassette *Cassette
+	session  *CassetteSession
+	closed   bool
+}
+
+func (c *recordingConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	c.record("downstream", buf[:n])
+	if err == io.EOF {
+		c.closedBy("upstream")
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(buf []byte) (int, error) {
+	n, err := c.Conn.Write(buf)
+	c.record("upstream", buf[:n])
+	return n, err
+}
+
+// CloseWrite half closes the upstream connection, if it supports it.
+func (c *recordingConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return closer.CloseWrite()
+	}
+	return errors.New("Connection can't be half closed")
+}
+
+func (c *recordingConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return c.Conn.Close()
+	}
+	c.closed = true
+	if len(c.session.ClosedBy) < 1 {
+		c.session.ClosedBy = "client"
+	}
+
+	err := c.cassette.addSession(c.session)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"cassette": c.cassette.path,
+			"err":      err,
+		}).Warn("Unable to save session to cassette")
+	}
+	return c.Conn.Close()
+}
+
+func (c *recordingConn) record(direction string, data []byte) {
+	if len(data) < 1 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return
+	}
+	event := CassetteEvent{direction, make([]byte, len(data))}
+	copy(event.Data, data)
+	c.session.Events = append(c.session.Events, event)
+}
+
+func (c *recordingConn) closedBy(side string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.session.ClosedBy) < 1 {
+		c.session.ClosedBy = side
+	}
+}
@@ -0,0 +1,178 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func WithCassettePath(t *testing.T, f func(string)) {
+	dir, err := ioutil.TempDir("", "toxiproxy")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f(filepath.Join(dir, "cassette.json"))
+}
+
+func NewReplayProxy(path, match string) *Proxy {
+	proxy := NewTestProxy("replay", "")
+	proxy.Cassette = path
+	proxy.CassetteMode = CassetteModeReplay
+	proxy.CassetteMatch = match
+	return proxy
+}
+
+func AssertReplay(t *testing.T, addr string, msg, expected []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Unable to dial replay proxy", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(msg)
+	if err != nil {
+		t.Error("Failed writing to replay proxy", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	scan := bufio.NewScanner(conn)
+	if !scan.Scan() {
+		t.Fatal("Replay proxy unexpectedly closed connection", scan.Err())
+	}
+	resp := append(scan.Bytes(), '\n')
+	if !bytes.Equal(resp, expected) {
+		t.Errorf("Replay proxy sent wrong data: %q expected %q", resp, expected)
+	}
+}
+
+func TestRecordAndReplayCassette(t *testing.T) {
+	WithCassettePath(t, func(path string) {
+		msg := []byte("hello world\n")
+
+		WithEchoServer(t, func(upstream string, response chan []byte) {
+			proxy := NewTestProxy("record", upstream)
+			proxy.Cassette = path
+			proxy.CassetteMode = CassetteModeRecord
+			err := proxy.Start()
+			if err != nil {
+				t.Fatal("Failed to start recording proxy", err)
+			}
+			defer proxy.Stop()
+
+			AssertReplay(t, proxy.Listen, msg, msg)
+		})
+
+		cassette, err := LoadCassette(path, CassetteMatchOrder)
+		if err != nil {
+			t.Fatal("Failed to load recorded cassette", err)
+		}
+		if len(cassette.Sessions) != 1 {
+			t.Fatalf("Expected 1 recorded session, got %d", len(cassette.Sessions))
+		}
+		if cassette.Sessions[0].ClosedBy != "client" {
+			t.Errorf("Expected session to be closed by client, got %s", cassette.Sessions[0].ClosedBy)
+		}
+
+		// The upstream is gone, but the session can still be replayed through toxics
+		proxy := NewReplayProxy(path, CassetteMatchOrder)
+		err = proxy.Start()
+		if err != nil {
+			t.Fatal("Failed to start replaying proxy", err)
+		}
+		defer proxy.Stop()
+		proxy.downToxics.SetToxicValue(&LatencyToxic{Enabled: true, Latency: 100})
+
+		start := time.Now()
+		AssertReplay(t, proxy.Listen, msg, msg)
+		AssertDeltaTime(t, "Replay latency", time.Since(start), 100*time.Millisecond, 20*time.Millisecond)
+
+		// The only session has been used up
+		conn, err := net.Dial("tcp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial replay proxy", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if err == nil {
+			t.Error("Expected replay proxy to close connection when cassette is exhausted")
+		}
+		conn.Close()
+	})
+}
+
+func TestReplayCassetteMatchPrefix(t *testing.T) {
+	WithCassettePath(t, func(path string) {
+		cassette, err := OpenCassette(path)
+		if err != nil {
+			t.Fatal("Failed to create cassette", err)
+		}
+		for _, name := range []string{"first", "second"} {
+			cassette.addSession(&CassetteSession{
+				Events: []CassetteEvent{
+					{"upstream", []byte("GET " + name + "\n")},
+					{"downstream", []byte("hello " + name + "\n")},
+				},
+				ClosedBy: "upstream",
+			})
+		}
+		cassette.Close()
+
+		proxy := NewReplayProxy(path, CassetteMatchPrefix)
+		err = proxy.Start()
+		if err != nil {
+			t.Fatal("Failed to start replaying proxy", err)
+		}
+		defer proxy.Stop()
+
+		AssertReplay(t, proxy.Listen, []byte("GET second\n"), []byte("hello second\n"))
+		AssertReplay(t, proxy.Listen, []byte("GET first\n"), []byte("hello first\n"))
+		AssertReplay(t, proxy.Listen, []byte("GET second\n"), []byte("hello second\n"))
+	})
+}
+
+func TestRecordCassetteAcrossRestart(t *testing.T) {
+	WithCassettePath(t, func(path string) {
+		proxy := NewTestProxy("record", "mock://echo")
+		proxy.Cassette = path
+		proxy.CassetteMode = CassetteModeRecord
+		for _, msg := range []string{"first\n", "second\n"} {
+			err := proxy.Start()
+			if err != nil {
+				t.Fatal("Failed to start recording proxy", err)
+			}
+			AssertReplay(t, proxy.Listen, []byte(msg), []byte(msg))
+			proxy.Stop()
+		}
+
+		cassette, err := LoadCassette(path, CassetteMatchOrder)
+		if err != nil {
+			t.Fatal("Failed to load recorded cassette", err)
+		}
+		if len(cassette.Sessions) != 2 {
+			t.Fatalf("Expected sessions of both runs to be kept, got %d", len(cassette.Sessions))
+		}
+		for i, msg := range []string{"first\n", "second\n"} {
+			if string(cassette.Sessions[i].Events[0].Data) != msg {
+				t.Errorf("Expected session %d to start with %q, got %q", i, msg, cassette.Sessions[i].Events[0].Data)
+			}
+		}
+	})
+}
+
+func TestReplayMissingCassette(t *testing.T) {
+	WithCassettePath(t, func(path string) {
+		proxy := NewReplayProxy(path, CassetteMatchOrder)
+		err := proxy.Start()
+		if err == nil {
+			proxy.Stop()
+			t.Fatal("Expected replaying proxy to fail without a cassette")
+		}
+	})
+}
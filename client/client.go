@@ -4,16 +4,35 @@ package toxiproxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 // Client holds information about where to connect to Toxiproxy.
 type Client struct {
-	endpoint string
+	endpoint   string
+	basePath   string
+	httpClient *http.Client
+	tlsConfig  *tls.Config
+	caBundle   string
+	err        error // Returned by every request, if an option failed
+	timeout    time.Duration
+	token      string
+	userAgent  string
 }
 
+// An Option configures a Client, see NewClient.
+type Option func(*Client)
+
 type Toxic map[string]interface{}
 type Toxics map[string]Toxic
 
@@ -24,33 +43,175 @@ type Proxy struct {
 	Upstream string `json:"upstream"` // The upstream address to proxy to
 	Enabled  bool   `json:"enabled"`  // Whether the proxy is enabled
 
+	Cassette      string `json:"cassette,omitempty"`       // The cassette file to record to or replay from
+	CassetteMode  string `json:"cassette_mode,omitempty"`  // Either "record" or "replay", if a cassette is used
+	CassetteMatch string `json:"cassette_match,omitempty"` // How replayed sessions are matched, "order" or "prefix"
+
+	MaxConnections   int     `json:"max_connections,omitempty"`   // The most clients connected at once, 0 for no limit
+	QueueConnections bool    `json:"queue_connections,omitempty"` // Whether clients over MaxConnections wait instead of being closed
+	AcceptRate       float64 `json:"accept_rate,omitempty"`       // The clients let in per second, 0 for no limit
+	Rejected         int64   `json:"rejected"`                    // The number of clients closed for being over MaxConnections
+	ResolveErrors    int64   `json:"resolve_errors"`              // The number of clients closed because the upstream couldn't be looked up
+	DialErrors       int64   `json:"dial_errors"`                 // The number of clients closed because the upstream couldn't be connected to
+
+	Frontend string `json:"frontend,omitempty"` // "connect" to forward clients to the destination they ask for with SOCKS5 or HTTP CONNECT
+	Rules    []Rule `json:"rules,omitempty"`    // The rules picking toxics by destination, if Frontend is "connect"
+
+	AcceptProxyProtocol bool   `json:"accept_proxy_protocol,omitempty"` // Whether clients start with a PROXY protocol header
+	SendProxyProtocol   string `json:"send_proxy_protocol,omitempty"`   // "v1" or "v2" to send a PROXY protocol header to the upstream
+
 	ToxicsUpstream   Toxics `json:"upstream_toxics"`   // Toxics in the upstream direction
 	ToxicsDownstream Toxics `json:"downstream_toxics"` // Toxics in the downstream direction
 
 	client *Client
 }
 
+// Rule picks the toxics of clients of a connect frontend asking for a matching
+// destination. The first matching rule is used.
+type Rule struct {
+	Name string `json:"name"` // The name of the rule, as passed to SetRuleToxic
+	Host string `json:"host"` // A glob matching the destination host, such as *.internal
+	Port string `json:"port"` // A glob matching the destination port
+}
+
+// ToxicType describes a toxic supported by Toxiproxy, including any registered
+// in a custom build.
+type ToxicType struct {
+	Name   string       `json:"name"`   // The name of the toxic, as passed to SetToxic
+	Fields []ToxicField `json:"fields"` // The parameters of the toxic
+}
+
+// ToxicField describes a parameter of a toxic.
+type ToxicField struct {
+	Name    string      `json:"name"`    // The JSON field name
+	Type    string      `json:"type"`    // The JSON type, e.g. "integer" or "boolean"
+	Default interface{} `json:"default"` // The value of a new toxic
+}
+
+// Recording represents the state of a proxy's traffic recording.
+type Recording struct {
+	Enabled bool   `json:"enabled"` // Whether traffic is being recorded
+	Path    string `json:"path"`    // The pcap-ng file on the Toxiproxy host to record to
+}
+
 // NewClient creates a new client which provides the base of all communication
 // with Toxiproxy. Endpoint is the address to the proxy (e.g. localhost:8474 if
-// not overriden)
-func NewClient(endpoint string) *Client {
-	return &Client{endpoint: endpoint}
+// not overriden). Options such as WithTimeout configure how the client talks
+// to Toxiproxy.
+func NewClient(endpoint string, options ...Option) *Client {
+	client := &Client{endpoint: endpoint, httpClient: http.DefaultClient}
+	for _, option := range options {
+		option(client)
+	}
+	if client.caBundle != "" {
+		client.err = client.loadCABundle()
+	}
+	if client.tlsConfig != nil {
+		client.applyTLSConfig()
+	}
+	return client
 }
 
-// Proxies returns a map with all the proxies and their toxics.
-func (client *Client) Proxies() (map[string]*Proxy, error) {
-	resp, err := http.Get(client.endpoint + "/proxies")
-	if err != nil {
-		return nil, err
+// WithHTTPClient makes the client send requests with httpClient instead of
+// http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(client *Client) {
+		client.httpClient = httpClient
 	}
+}
 
-	err = checkError(resp, http.StatusOK, "Proxies")
+// WithTimeout limits how long each request to Toxiproxy can take, including
+// reading the response. This applies on top of the deadline of the context
+// passed to each method.
+func WithTimeout(timeout time.Duration) Option {
+	return func(client *Client) {
+		client.timeout = timeout
+	}
+}
+
+// WithBasePath prefixes the path of every request, for a Toxiproxy served
+// behind a reverse proxy (e.g. /toxiproxy).
+func WithBasePath(basePath string) Option {
+	return func(client *Client) {
+		client.basePath = basePath
+	}
+}
+
+// WithToken sends token as a bearer token with every request, for a Toxiproxy
+// API which requires authentication.
+func WithToken(token string) Option {
+	return func(client *Client) {
+		client.token = token
+	}
+}
+
+// WithUserAgent sets the User-Agent header of every request.
+func WithUserAgent(userAgent string) Option {
+	return func(client *Client) {
+		client.userAgent = userAgent
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to a Toxiproxy
+// serving its API over HTTPS, e.g. to present a client certificate.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(client *Client) {
+		client.tlsConfig = config
+	}
+}
+
+// WithCABundle trusts only the CAs in the PEM file at path when verifying the
+// certificate of the Toxiproxy API. If the file can't be loaded, every request
+// returns the error.
+func WithCABundle(path string) Option {
+	return func(client *Client) {
+		client.caBundle = path
+	}
+}
+
+func (client *Client) loadCABundle() error {
+	data, err := ioutil.ReadFile(client.caBundle)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("No certificates found in %s", client.caBundle)
+	}
+
+	config := new(tls.Config)
+	if client.tlsConfig != nil {
+		config = client.tlsConfig.Clone()
+	}
+	config.RootCAs = pool
+	client.tlsConfig = config
+	return nil
+}
+
+// Replaces the HTTP client with a copy using the TLS config. Custom transports
+// which aren't an *http.Transport are left alone.
+func (client *Client) applyTLSConfig() {
+	transport := http.DefaultTransport.(*http.Transport)
+	if client.httpClient.Transport != nil {
+		var ok bool
+		transport, ok = client.httpClient.Transport.(*http.Transport)
+		if !ok {
+			return
+		}
 	}
 
+	transport = transport.Clone()
+	transport.TLSClientConfig = client.tlsConfig
+	httpClient := *client.httpClient
+	httpClient.Transport = transport
+	client.httpClient = &httpClient
+}
+
+// Proxies returns a map with all the proxies and their toxics.
+func (client *Client) Proxies(ctx context.Context) (map[string]*Proxy, error) {
 	proxies := make(map[string]*Proxy)
-	err = json.NewDecoder(resp.Body).Decode(&proxies)
+	err := client.do(ctx, "GET", "/proxies", nil, http.StatusOK, "Proxies", &proxies)
 	if err != nil {
 		return nil, err
 	}
@@ -74,158 +235,225 @@ func (client *Client) NewProxy(proxy *Proxy) *Proxy {
 }
 
 // Create creates a new proxy.
-func (proxy *Proxy) Create() error {
-	request, err := json.Marshal(proxy)
-	if err != nil {
-		return err
-	}
+func (proxy *Proxy) Create(ctx context.Context) error {
+	return proxy.client.do(ctx, "POST", "/proxies", proxy, http.StatusCreated, "Create", new(Proxy))
+}
 
-	resp, err := http.Post(proxy.client.endpoint+"/proxies", "application/json", bytes.NewReader(request))
+// Proxy returns a proxy by name.
+func (client *Client) Proxy(ctx context.Context, name string) (*Proxy, error) {
+	proxy := client.NewProxy(nil)
+	err := client.do(ctx, "GET", "/proxies/"+url.PathEscape(name), nil, http.StatusOK, "Proxy", proxy)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = checkError(resp, http.StatusCreated, "Create")
-	if err != nil {
-		return err
-	}
+	return proxy, nil
+}
 
-	proxy = new(Proxy)
-	err = json.NewDecoder(resp.Body).Decode(&proxy)
-	if err != nil {
-		return err
-	}
+// Save saves changes to a proxy such as its enabled status.
+func (proxy *Proxy) Save(ctx context.Context) error {
+	return proxy.client.do(ctx, "POST", proxy.path(""), proxy, http.StatusOK, "Save", proxy)
+}
 
-	return nil
+// ListenAddresses returns the addresses the proxy listens on. A proxy created
+// with a port range or a list of addresses listens on several.
+func (proxy *Proxy) ListenAddresses() []string {
+	return strings.Split(proxy.Listen, ",")
 }
 
-// Proxy returns a proxy by name.
-func (client *Client) Proxy(name string) (*Proxy, error) {
-	// TODO url encode
-	resp, err := http.Get(client.endpoint + "/proxies/" + name)
+// Delete a proxy which will cause it to stop listening and delete all
+// information associated with it. If you just wish to stop and later enable a
+// proxy, set the `Enabled` field to `false` and call `Save()`.
+func (proxy *Proxy) Delete(ctx context.Context) error {
+	return proxy.client.do(ctx, "DELETE", proxy.path(""), nil, http.StatusNoContent, "Delete", nil)
+}
+
+// Toxics returns a map of all the toxics and their attributes for a direction.
+func (proxy *Proxy) Toxics(ctx context.Context, direction string) (Toxics, error) {
+	toxics := make(Toxics)
+	err := proxy.client.do(ctx, "GET", proxy.path("/"+direction+"/toxics"), nil, http.StatusOK, "Toxics", &toxics)
 	if err != nil {
 		return nil, err
 	}
 
-	err = checkError(resp, http.StatusOK, "Proxy")
+	return toxics, nil
+}
+
+// SetToxic sets the parameters for a toxic with a given name in the direction.
+// See https://github.com/Shopify/toxiproxy#toxics for a list of all Toxics.
+func (proxy *Proxy) SetToxic(ctx context.Context, name string, direction string, toxic Toxic) (Toxic, error) {
+	result := make(Toxic)
+	err := proxy.client.do(ctx, "POST", proxy.path("/"+direction+"/toxics/"+url.PathEscape(name)), toxic, http.StatusOK, "SetToxic", &result)
 	if err != nil {
 		return nil, err
 	}
 
-	proxy := client.NewProxy(nil)
-	err = json.NewDecoder(resp.Body).Decode(proxy)
+	return result, nil
+}
+
+// RuleToxics returns a map of all the toxics and their attributes of the rule
+// for a direction.
+func (proxy *Proxy) RuleToxics(ctx context.Context, rule string, direction string) (Toxics, error) {
+	toxics := make(Toxics)
+	err := proxy.client.do(ctx, "GET", proxy.path("/rules/"+url.PathEscape(rule)+"/"+direction+"/toxics"), nil, http.StatusOK, "RuleToxics", &toxics)
 	if err != nil {
 		return nil, err
 	}
 
-	return proxy, nil
+	return toxics, nil
 }
 
-// Save saves changes to a proxy such as its enabled status.
-func (proxy *Proxy) Save() error {
-	request, err := json.Marshal(proxy)
+// SetRuleToxic sets the parameters for a toxic with a given name in the
+// direction, for clients matching the rule.
+func (proxy *Proxy) SetRuleToxic(ctx context.Context, rule string, name string, direction string, toxic Toxic) (Toxic, error) {
+	result := make(Toxic)
+	err := proxy.client.do(ctx, "POST", proxy.path("/rules/"+url.PathEscape(rule)+"/"+direction+"/toxics/"+url.PathEscape(name)), toxic, http.StatusOK, "SetRuleToxic", &result)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	resp, err := http.Post(proxy.client.endpoint+"/proxies/"+proxy.Name, "application/json", bytes.NewReader(request))
-	if err != nil {
-		return err
-	}
+	return result, nil
+}
 
-	err = checkError(resp, http.StatusOK, "Save")
+// Recording returns the state of the proxy's traffic recording.
+func (proxy *Proxy) Recording(ctx context.Context) (*Recording, error) {
+	recording := new(Recording)
+	err := proxy.client.do(ctx, "GET", proxy.path("/record"), nil, http.StatusOK, "Recording", recording)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(proxy)
+	return recording, nil
+}
+
+// SetRecording starts or stops recording the proxy's traffic to a pcap-ng file.
+// The capture contains data both before and after it passes through the toxics.
+func (proxy *Proxy) SetRecording(ctx context.Context, recording Recording) (*Recording, error) {
+	result := new(Recording)
+	err := proxy.client.do(ctx, "POST", proxy.path("/record"), recording, http.StatusOK, "SetRecording", result)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return result, nil
 }
 
-// Delete a proxy which will cause it to stop listening and delete all
-// information associated with it. If you just wish to stop and later enable a
-// proxy, set the `Enabled` field to `false` and call `Save()`.
-func (proxy *Proxy) Delete() error {
-	httpClient := &http.Client{}
-	req, err := http.NewRequest("DELETE", proxy.client.endpoint+"/proxies/"+proxy.Name, nil)
-
-	if err != nil {
-		return err
+// AcceptPaused returns whether the proxy stopped accepting clients.
+func (proxy *Proxy) AcceptPaused(ctx context.Context) (bool, error) {
+	var state struct {
+		Paused bool `json:"paused"`
 	}
+	err := proxy.client.do(ctx, "GET", proxy.path("/accept"), nil, http.StatusOK, "AcceptPaused", &state)
+	return state.Paused, err
+}
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return err
-	}
+// PauseAccept stops the proxy accepting clients, while keeping it listening.
+// New clients hang in connect once the listen backlog is full.
+func (proxy *Proxy) PauseAccept(ctx context.Context) error {
+	return proxy.setAccept(ctx, true, "PauseAccept")
+}
 
-	return checkError(resp, http.StatusNoContent, "Delete")
+// ResumeAccept accepts clients again after PauseAccept.
+func (proxy *Proxy) ResumeAccept(ctx context.Context) error {
+	return proxy.setAccept(ctx, false, "ResumeAccept")
 }
 
-// Toxics returns a map of all the toxics and their attributes for a direction.
-func (proxy *Proxy) Toxics(direction string) (Toxics, error) {
-	resp, err := http.Get(proxy.client.endpoint + "/proxies/" + proxy.Name + "/" + direction + "/toxics")
-	if err != nil {
-		return nil, err
-	}
+func (proxy *Proxy) setAccept(ctx context.Context, paused bool, op string) error {
+	state := struct {
+		Paused bool `json:"paused"`
+	}{paused}
+	return proxy.client.do(ctx, "POST", proxy.path("/accept"), state, http.StatusOK, op, &state)
+}
 
-	err = checkError(resp, http.StatusOK, "Toxics")
+// ToxicTypes returns the toxics supported by Toxiproxy, in the order they are
+// applied to each connection.
+func (client *Client) ToxicTypes(ctx context.Context) ([]ToxicType, error) {
+	var types []ToxicType
+	err := client.do(ctx, "GET", "/toxics/types", nil, http.StatusOK, "ToxicTypes", &types)
 	if err != nil {
 		return nil, err
 	}
 
-	toxics := make(Toxics)
-	err = json.NewDecoder(resp.Body).Decode(&toxics)
-	if err != nil {
-		return nil, err
-	}
+	return types, nil
+}
 
-	return toxics, nil
+// ResetState resets the state of all proxies and toxics in Toxiproxy.
+func (client *Client) ResetState(ctx context.Context) error {
+	return client.do(ctx, "GET", "/reset", nil, http.StatusNoContent, "ResetState", nil)
 }
 
-// SetToxic sets the parameters for a toxic with a given name in the direction.
-// See https://github.com/Shopify/toxiproxy#toxics for a list of all Toxics.
-func (proxy *Proxy) SetToxic(name string, direction string, toxic Toxic) (Toxic, error) {
-	request, err := json.Marshal(toxic)
-	if err != nil {
-		return nil, err
+// Returns the API path of the proxy, followed by suffix.
+func (proxy *Proxy) path(suffix string) string {
+	return "/proxies/" + url.PathEscape(proxy.Name) + suffix
+}
+
+// do sends a request with input encoded as JSON, and decodes the response into
+// output if it has the expected status code. Otherwise an *ApiError is
+// returned, wrapped with the name of the caller.
+func (client *Client) do(ctx context.Context, method, path string, input interface{}, expectedCode int, caller string, output interface{}) error {
+	if client.err != nil {
+		return client.err
+	}
+	if client.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.timeout)
+		defer cancel()
 	}
 
-	resp, err := http.Post(proxy.client.endpoint+"/proxies/"+proxy.Name+"/"+direction+"/toxics/"+name, "application/json", bytes.NewReader(request))
-	if err != nil {
-		return nil, err
+	var body io.Reader
+	if input != nil {
+		data, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
 	}
 
-	err = checkError(resp, http.StatusOK, "SetToxic")
+	req, err := http.NewRequest(method, client.endpoint+client.basePath+path, body)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	req = req.WithContext(ctx)
 
-	toxics := make(Toxic)
-	err = json.NewDecoder(resp.Body).Decode(&toxics)
-	if err != nil {
-		return nil, err
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client.token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.token)
+	}
+	if client.userAgent != "" {
+		req.Header.Set("User-Agent", client.userAgent)
 	}
 
-	return toxics, nil
-}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-// ResetState resets the state of all proxies and toxics in Toxiproxy.
-func (client *Client) ResetState() error {
-	resp, err := http.Get(client.endpoint + "/reset")
+	err = checkError(resp, expectedCode, caller)
 	if err != nil {
 		return err
 	}
 
-	return checkError(resp, http.StatusNoContent, "ResetState")
+	if output != nil {
+		return json.NewDecoder(resp.Body).Decode(output)
+	}
+	return nil
 }
 
+// ApiError is the error returned by the Toxiproxy API. Use errors.As to tell
+// apart, for example, a missing proxy (404) from a conflict (409).
 type ApiError struct {
-	Title  string `json:"title"`
-	Status int    `json:"status"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Errors []FieldError `json:"errors,omitempty"` // The invalid fields, when setting a toxic
+}
+
+// FieldError describes why a field of a toxic was rejected by Toxiproxy.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
 func (err *ApiError) Error() string {
@@ -240,7 +468,7 @@ func checkError(resp *http.Response, expectedCode int, caller string) error {
 			apiError.Title = fmt.Sprintf("Unexpected response code, expected %d", expectedCode)
 			apiError.Status = resp.StatusCode
 		}
-		return fmt.Errorf("%s: %v", caller, apiError)
+		return fmt.Errorf("%s: %w", caller, apiError)
 	}
 	return nil
 }
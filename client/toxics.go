@@ -0,0 +1,132 @@
+package toxiproxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Directions a toxic can be applied in. Upstream toxics affect data sent by the
+// client, downstream toxics affect data sent by the upstream.
+const (
+	Upstream   = "upstream"
+	Downstream = "downstream"
+)
+
+// A TypedToxic is a toxic with its parameters as struct fields, as opposed to
+// the generic Toxic map. See SetTypedToxic.
+type TypedToxic interface {
+	// ToxicName returns the name of the toxic, as used by the API.
+	ToxicName() string
+}
+
+// LatencyToxic delays all data by Latency +/- Jitter milliseconds. Distribution
+// is one of uniform (the default), normal, pareto, pareto_normal or empirical,
+// which picks from Histogram. Correlation is the percentage each delay depends
+// on the previous one.
+type LatencyToxic struct {
+	Enabled      bool              `json:"enabled"`
+	Latency      int64             `json:"latency"`
+	Jitter       int64             `json:"jitter"`
+	Distribution string            `json:"distribution"`
+	Correlation  float64           `json:"correlation"`
+	Histogram    []HistogramBucket `json:"histogram"`
+}
+
+// HistogramBucket is a delay in milliseconds of the empirical latency
+// distribution, picked in proportion to its Weight.
+type HistogramBucket struct {
+	Latency int64   `json:"latency"`
+	Weight  float64 `json:"weight"`
+}
+
+// BandwidthToxic limits data to Rate KB/s, with bursts of up to Burst KB. Scope
+// is connection (the default) or proxy, to share the limit between connections.
+type BandwidthToxic struct {
+	Enabled bool   `json:"enabled"`
+	Rate    int64  `json:"rate"`
+	Burst   int64  `json:"burst"`
+	Scope   string `json:"scope"`
+}
+
+// SlicerToxic slices data into chunks of AverageSize +/- SizeVariation bytes,
+// delaying each by Delay microseconds.
+type SlicerToxic struct {
+	Enabled       bool `json:"enabled"`
+	AverageSize   int  `json:"average_size"`
+	SizeVariation int  `json:"size_variation"`
+	Delay         int  `json:"delay"`
+}
+
+// TimeoutToxic stops all data, and closes the connection after Timeout
+// milliseconds, unless it's 0.
+type TimeoutToxic struct {
+	Enabled bool  `json:"enabled"`
+	Timeout int64 `json:"timeout"`
+}
+
+// SlowCloseToxic delays closing the connection by Delay milliseconds.
+type SlowCloseToxic struct {
+	Enabled bool  `json:"enabled"`
+	Delay   int64 `json:"delay"`
+}
+
+func (t *LatencyToxic) ToxicName() string   { return "latency" }
+func (t *BandwidthToxic) ToxicName() string { return "bandwidth" }
+func (t *SlicerToxic) ToxicName() string    { return "slicer" }
+func (t *TimeoutToxic) ToxicName() string   { return "timeout" }
+func (t *SlowCloseToxic) ToxicName() string { return "slow_close" }
+
+// SetTypedToxic sets the parameters of a toxic in the direction, and updates
+// toxic with the parameters returned by Toxiproxy.
+func (proxy *Proxy) SetTypedToxic(ctx context.Context, direction string, toxic TypedToxic) error {
+	path := proxy.path("/" + direction + "/toxics/" + url.PathEscape(toxic.ToxicName()))
+	return proxy.client.do(ctx, "POST", path, toxic, http.StatusOK, "SetToxic", toxic)
+}
+
+// AddLatency enables the latency toxic in the direction.
+func (proxy *Proxy) AddLatency(ctx context.Context, direction string, latency, jitter time.Duration) (*LatencyToxic, error) {
+	toxic := &LatencyToxic{
+		Enabled: true,
+		Latency: int64(latency / time.Millisecond),
+		Jitter:  int64(jitter / time.Millisecond),
+	}
+	return toxic, proxy.SetTypedToxic(ctx, direction, toxic)
+}
+
+// AddBandwidth enables the bandwidth toxic in the direction, with a rate in KB/s.
+func (proxy *Proxy) AddBandwidth(ctx context.Context, direction string, rate int64) (*BandwidthToxic, error) {
+	toxic := &BandwidthToxic{Enabled: true, Rate: rate, Scope: "connection"}
+	return toxic, proxy.SetTypedToxic(ctx, direction, toxic)
+}
+
+// AddSlicer enables the slicer toxic in the direction.
+func (proxy *Proxy) AddSlicer(ctx context.Context, direction string, averageSize, sizeVariation int, delay time.Duration) (*SlicerToxic, error) {
+	toxic := &SlicerToxic{
+		Enabled:       true,
+		AverageSize:   averageSize,
+		SizeVariation: sizeVariation,
+		Delay:         int(delay / time.Microsecond),
+	}
+	return toxic, proxy.SetTypedToxic(ctx, direction, toxic)
+}
+
+// AddTimeout enables the timeout toxic in the direction.
+func (proxy *Proxy) AddTimeout(ctx context.Context, direction string, timeout time.Duration) (*TimeoutToxic, error) {
+	toxic := &TimeoutToxic{Enabled: true, Timeout: int64(timeout / time.Millisecond)}
+	return toxic, proxy.SetTypedToxic(ctx, direction, toxic)
+}
+
+// AddSlowClose enables the slow_close toxic in the direction.
+func (proxy *Proxy) AddSlowClose(ctx context.Context, direction string, delay time.Duration) (*SlowCloseToxic, error) {
+	toxic := &SlowCloseToxic{Enabled: true, Delay: int64(delay / time.Millisecond)}
+	return toxic, proxy.SetTypedToxic(ctx, direction, toxic)
+}
+
+// RemoveToxic disables the toxic with the given name in the direction, keeping
+// its parameters.
+func (proxy *Proxy) RemoveToxic(ctx context.Context, direction string, name string) error {
+	_, err := proxy.SetToxic(ctx, name, direction, Toxic{"enabled": false})
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"time"
+
+	"github.com/Shopify/toxiproxy"
+	"github.com/Sirupsen/logrus"
+)
+
+var host string
+var port string
+var apiTokens string
+var apiTLSCert string
+var apiTLSKey string
+var apiTLSClientCA string
+var seed int64
+var dnsServer string
+var dnsTTL time.Duration
+var recordDir string
+
+func init() {
+	flag.StringVar(&host, "host", "localhost", "Host for toxiproxy's API to listen on")
+	flag.StringVar(&port, "port", "8474", "Port for toxiproxy's API to listen on")
+	flag.StringVar(&apiTokens, "api-tokens", "", "JSON file with the tokens allowed to use toxiproxy's API")
+	flag.StringVar(&apiTLSCert, "api-tls-cert", "", "PEM certificate to serve toxiproxy's API over TLS with")
+	flag.StringVar(&apiTLSKey, "api-tls-key", "", "PEM key for the certificate of toxiproxy's API")
+	flag.StringVar(&apiTLSClientCA, "api-tls-client-ca", "", "PEM CA bundle to verify client certificates for toxiproxy's API with")
+	flag.StringVar(&dnsServer, "dns-server", "", "DNS server to resolve upstreams with, instead of the system resolver")
+	flag.DurationVar(&dnsTTL, "dns-ttl", 0, "How long to cache the resolved addresses of upstreams for")
+	flag.StringVar(&recordDir, "record-dir", "", "Directory the API can write traffic recordings to, recording is disabled if empty")
+	flag.Int64Var(&seed, "seed", time.Now().UTC().UnixNano(), "Seed for randomizing toxics with")
+}
+
+func main() {
+	flag.Parse()
+	rand.Seed(seed)
+	toxiproxy.DefaultResolver.Address = dnsServer
+	toxiproxy.DefaultResolver.TTL = dnsTTL
+
+	server := toxiproxy.NewServer()
+	server.RecordDir = recordDir
+	if apiTokens != "" {
+		tokens, err := toxiproxy.LoadTokens(apiTokens)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"path": apiTokens,
+				"err":  err,
+			}).Fatal("Unable to load API tokens")
+		}
+		server.RequireTokens = true
+		server.Tokens = tokens
+	}
+	if apiTLSCert != "" || apiTLSKey != "" {
+		config, err := toxiproxy.LoadTLSConfig(apiTLSCert, apiTLSKey, apiTLSClientCA)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"cert": apiTLSCert,
+				"key":  apiTLSKey,
+				"err":  err,
+			}).Fatal("Unable to load API TLS certificate")
+		}
+		server.TLSConfig = config
+	} else if apiTLSClientCA != "" {
+		logrus.Fatal("-api-tls-client-ca requires -api-tls-cert and -api-tls-key")
+	}
+
+	err := server.Listen(host, port)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"host": host,
+			"port": port,
+			"err":  err,
+		}).Fatal("Unable to start API HTTP server")
+	}
+}
@@ -0,0 +1,320 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FrontendConnect makes a proxy forward each client to the destination it
+// asks for with SOCKS5 or HTTP CONNECT, instead of to the upstream.
+const FrontendConnect = "connect"
+
+// How long a client has to ask for a destination.
+const frontendTimeout = 10 * time.Second
+
+// A Rule picks the toxics for clients of a connect frontend, by matching their
+// destination against the Host and Port globs, such as *.internal and 54*.
+// Empty globs match anything. Clients not matching any rule go through the
+// toxics of the proxy itself.
+type Rule struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port string `json:"port"`
+
+	upToxics   *ToxicCollection
+	downToxics *ToxicCollection
+}
+
+func (rule *Rule) matches(host, port string) bool {
+	hostMatch, _ := path.Match(strings.ToLower(rule.Host), strings.ToLower(host))
+	portMatch, _ := path.Match(rule.Port, port)
+	return (rule.Host == "" || hostMatch) && (rule.Port == "" || portMatch)
+}
+
+// validateFrontend checks the frontend and rules of a proxy.
+func validateFrontend(proxy *Proxy) error {
+	if proxy.Frontend != "" && proxy.Frontend != FrontendConnect {
+		return fmt.Errorf("Invalid frontend: %s", proxy.Frontend)
+	}
+	if proxy.Frontend != "" && proxy.CassetteMode != "" {
+		return errors.New("Invalid frontend: can't be used with a cassette")
+	}
+
+	names := make(map[string]bool)
+	for _, rule := range proxy.Rules {
+		if rule.Name == "" {
+			return errors.New("Missing required field: rule name")
+		} else if names[rule.Name] {
+			return fmt.Errorf("Duplicate rule name: %s", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if _, err := path.Match(rule.Host, ""); err != nil {
+			return fmt.Errorf("Invalid rule host: %s", rule.Host)
+		}
+		if _, err := path.Match(rule.Port, ""); err != nil {
+			return fmt.Errorf("Invalid rule port: %s", rule.Port)
+		}
+	}
+	return nil
+}
+
+// Replaces the rules of the proxy, keeping the toxics of rules with the same
+// name.
+func (proxy *Proxy) setRules(rules []*Rule) {
+	proxy.connections.Lock()
+	defer proxy.connections.Unlock()
+
+	existing := make(map[string]*Rule)
+	for _, rule := range proxy.Rules {
+		existing[rule.Name] = rule
+	}
+	for _, rule := range rules {
+		if old, ok := existing[rule.Name]; ok {
+			rule.upToxics, rule.downToxics = old.upToxics, old.downToxics
+		} else {
+			rule.upToxics = NewToxicCollection(proxy)
+			rule.downToxics = NewToxicCollection(proxy)
+			rule.downToxics.downstream = true
+		}
+	}
+	proxy.Rules = rules
+}
+
+// Returns a copy of the rules of the proxy, without their toxics.
+func (proxy *Proxy) copyRules() []*Rule {
+	proxy.connections.Lock()
+	defer proxy.connections.Unlock()
+	var rules []*Rule
+	for _, rule := range proxy.Rules {
+		rules = append(rules, &Rule{Name: rule.Name, Host: rule.Host, Port: rule.Port})
+	}
+	return rules
+}
+
+// Returns the toxics for a client connecting to the destination through the
+// frontend.
+func (proxy *Proxy) matchRule(destination string) (*ToxicCollection, *ToxicCollection) {
+	host, port, _ := net.SplitHostPort(destination)
+
+	proxy.connections.Lock()
+	defer proxy.connections.Unlock()
+	for _, rule := range proxy.Rules {
+		if rule.matches(host, port) {
+			return rule.upToxics, rule.downToxics
+		}
+	}
+	return proxy.upToxics, proxy.downToxics
+}
+
+// Returns the toxics of the rule with the given name in the direction.
+func (proxy *Proxy) ruleToxics(name, direction string) (*ToxicCollection, error) {
+	proxy.connections.Lock()
+	defer proxy.connections.Unlock()
+	for _, rule := range proxy.Rules {
+		if rule.Name != name {
+			continue
+		}
+		switch direction {
+		case Upstream:
+			return rule.upToxics, nil
+		case Downstream:
+			return rule.downToxics, nil
+		}
+		return nil, fmt.Errorf("Invalid toxic direction: %s", direction)
+	}
+	return nil, fmt.Errorf("Rule with name %s doesn't exist", name)
+}
+
+// Returns the toxics of the rules of the proxy, in both directions.
+func (proxy *Proxy) allRuleToxics() []*ToxicCollection {
+	proxy.connections.Lock()
+	defer proxy.connections.Unlock()
+	var collections []*ToxicCollection
+	for _, rule := range proxy.Rules {
+		collections = append(collections, rule.upToxics, rule.downToxics)
+	}
+	return collections
+}
+
+// A connectRequest is the destination a client of a connect frontend asked
+// for, with SOCKS5 or HTTP CONNECT.
+type connectRequest struct {
+	Destination string
+	// The client, including any data it sent after the request
+	conn  net.Conn
+	socks bool
+}
+
+// Reads the SOCKS5 or HTTP CONNECT request of the client. Requests that can't
+// be served are answered with an error.
+func readConnectRequest(client net.Conn) (*connectRequest, error) {
+	reader := bufio.NewReader(client)
+	version, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &connectRequest{conn: client, socks: version[0] == 5}
+	if request.socks {
+		request.Destination, err = readSOCKS5Request(reader, client)
+	} else {
+		request.Destination, err = readHTTPConnectRequest(reader, client)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if reader.Buffered() > 0 {
+		request.conn = &bufferedConn{client, reader}
+	}
+	return request, nil
+}
+
+// SOCKS5 reply codes, from RFC 1928.
+const (
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksHostUnreachable     = 4
+	socksConnectionRefused   = 5
+	socksCommandNotSupported = 7
+	socksAddressNotSupported = 8
+)
+
+func readSOCKS5Request(reader *bufio.Reader, client net.Conn) (string, error) {
+	// Only clients without authentication are supported
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	if !bytes.Contains(methods, []byte{0}) {
+		client.Write([]byte{5, 0xff})
+		return "", errors.New("SOCKS5 client requires authentication")
+	}
+	if _, err := client.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return "", err
+	}
+	if request[1] != 1 {
+		writeSOCKS5Reply(client, socksCommandNotSupported)
+		return "", fmt.Errorf("Unsupported SOCKS5 command: %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case 1, 4: // IPv4 and IPv6
+		ip := make([]byte, 4)
+		if request[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3: // Domain name
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, size)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKS5Reply(client, socksAddressNotSupported)
+		return "", fmt.Errorf("Unsupported SOCKS5 address type: %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func writeSOCKS5Reply(client net.Conn, code byte) error {
+	// The bound address isn't useful to clients, so it's always 0.0.0.0:0
+	_, err := client.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func readHTTPConnectRequest(reader *bufio.Reader, client net.Conn) (string, error) {
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return "", err
+	}
+	if request.Method != http.MethodConnect {
+		io.WriteString(client, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return "", fmt.Errorf("Unsupported HTTP method: %s", request.Method)
+	}
+	if _, _, err := net.SplitHostPort(request.Host); err != nil {
+		io.WriteString(client, "HTTP/1.1 400 Bad Request\r\n\r\n")
+		return "", err
+	}
+	return request.Host, nil
+}
+
+// Tells the client whether the destination was connected to, given the error
+// dialing it. A client that went away is noticed by the links.
+func (request *connectRequest) reply(err error) {
+	if !request.socks {
+		status := "200 Connection established"
+		if err != nil {
+			status = "502 Bad Gateway"
+		}
+		io.WriteString(request.conn, "HTTP/1.1 "+status+"\r\n\r\n")
+		return
+	}
+
+	code := byte(socksSucceeded)
+	if _, ok := err.(*ResolveError); ok {
+		code = socksHostUnreachable
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		code = socksConnectionRefused
+	} else if err != nil {
+		code = socksGeneralFailure
+	}
+	writeSOCKS5Reply(request.conn, code)
+}
+
+// A bufferedConn reads data buffered while reading a connect request before
+// the rest of the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+// CloseWrite half closes the connection, if it supports it, so toxics can half
+// close clients of frontends and the PROXY protocol.
+func (conn *bufferedConn) CloseWrite() error {
+	if closer, ok := conn.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return closer.CloseWrite()
+	}
+	return errors.New("Connection can't be half closed")
+}
@@ -0,0 +1,181 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func NewTestFrontendProxy(rules ...*Rule) *Proxy {
+	proxy := NewTestProxy("test", "")
+	proxy.Frontend = FrontendConnect
+	proxy.setRules(rules)
+	return proxy
+}
+
+// Asks the proxy for the destination with SOCKS5, returning the reply code.
+func SOCKS5Connect(t *testing.T, conn net.Conn, host string, port int) byte {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	conn.Write([]byte{5, 1, 0})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != 0 {
+		t.Fatal("Expected no authentication method, got", method, err)
+	}
+
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		request = append(append(request, 1), ip...)
+	} else {
+		request = append(append(request, 3, byte(len(host))), host...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	conn.Write(request)
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal("Failed to read SOCKS5 reply", err)
+	}
+	return reply[1]
+}
+
+func TestFrontendSOCKS5(t *testing.T) {
+	WithTCPServer(t, func(upstream string, response chan []byte) {
+		proxy := NewTestFrontendProxy()
+		proxy.Start()
+		defer proxy.Stop()
+
+		host, port, _ := net.SplitHostPort(upstream)
+		portNumber, _ := strconv.Atoi(port)
+
+		conn := AssertProxyUp(t, proxy.Listen, true)
+		if code := SOCKS5Connect(t, conn, host, portNumber); code != socksSucceeded {
+			t.Fatal("Expected SOCKS5 connect to succeed, got", code)
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+		if resp := <-response; string(resp) != "hello" {
+			t.Fatalf("Expected destination to receive hello, got %q", resp)
+		}
+	})
+}
+
+func TestFrontendHTTPConnect(t *testing.T) {
+	WithTCPServer(t, func(upstream string, response chan []byte) {
+		proxy := NewTestFrontendProxy()
+		proxy.Start()
+		defer proxy.Stop()
+
+		// Data sent right after the request goes to the destination
+		conn := AssertProxyUp(t, proxy.Listen, true)
+		conn.Write([]byte("CONNECT " + upstream + " HTTP/1.1\r\nHost: " + upstream + "\r\n\r\nhello"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		status, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || !strings.HasPrefix(status, "HTTP/1.1 200") {
+			t.Fatalf("Expected connection to be established, got %q: %v", status, err)
+		}
+		conn.Close()
+		if resp := <-response; string(resp) != "hello" {
+			t.Fatalf("Expected destination to receive hello, got %q", resp)
+		}
+	})
+}
+
+func TestFrontendRejectsOtherRequests(t *testing.T) {
+	proxy := NewTestFrontendProxy()
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn := AssertProxyUp(t, proxy.Listen, true)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, "HTTP/1.1 405") {
+		t.Fatalf("Expected method not to be allowed, got %q: %v", status, err)
+	}
+}
+
+func TestFrontendRuleToxics(t *testing.T) {
+	WithTCPServer(t, func(upstream string, response chan []byte) {
+		dns := NewTestDNSServer(t)
+		defer dns.Close()
+		dns.SetHost("db.toxiproxy.test", "127.0.0.1")
+
+		host, port, _ := net.SplitHostPort(upstream)
+		portNumber, _ := strconv.Atoi(port)
+
+		proxy := NewTestFrontendProxy(&Rule{Name: "db", Host: "DB.*"})
+		proxy.resolver = NewResolver(dns.Addr, 0)
+		proxy.Start()
+		defer proxy.Stop()
+
+		err := proxy.AddRuleToxic("db", "upstream", &DNSToxic{Mode: DNSModeNXDomain, Probability: 100})
+		if err != nil {
+			t.Fatal("Failed to add rule toxic", err)
+		}
+
+		conn := AssertProxyUp(t, proxy.Listen, true)
+		if code := SOCKS5Connect(t, conn, "db.toxiproxy.test", portNumber); code != socksHostUnreachable {
+			t.Fatal("Expected rule toxic to fail the lookup, got", code)
+		}
+		conn.Close()
+
+		// Destinations not matching the rule don't go through its toxics
+		conn = AssertProxyUp(t, proxy.Listen, true)
+		if code := SOCKS5Connect(t, conn, host, portNumber); code != socksSucceeded {
+			t.Fatal("Expected SOCKS5 connect to succeed, got", code)
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+		if resp := <-response; string(resp) != "hello" {
+			t.Fatalf("Expected destination to receive hello, got %q", resp)
+		}
+	})
+}
+
+func TestFrontendKeepsRuleToxics(t *testing.T) {
+	proxy := NewTestFrontendProxy(&Rule{Name: "db", Port: "3306"})
+	err := proxy.AddRuleToxic("db", "downstream", &LatencyToxic{Latency: 100})
+	if err != nil {
+		t.Fatal("Failed to add rule toxic", err)
+	}
+
+	proxy.setRules([]*Rule{{Name: "db", Port: "33*"}, {Name: "cache"}})
+	toxics, err := proxy.ruleToxics("db", "downstream")
+	if err != nil {
+		t.Fatal("Failed to get rule toxics", err)
+	}
+	if !toxics.GetToxicMap()["latency"].IsEnabled() {
+		t.Fatal("Expected rule toxics to be kept when the rule is updated")
+	}
+	if _, err := proxy.ruleToxics("missing", "upstream"); err == nil {
+		t.Fatal("Expected error getting toxics of a missing rule")
+	}
+}
+
+func TestValidateFrontend(t *testing.T) {
+	cases := []struct {
+		proxy *Proxy
+		err   string
+	}{
+		{&Proxy{Frontend: FrontendConnect, Rules: []*Rule{{Name: "db", Host: "*.internal", Port: "54*"}}}, ""},
+		{&Proxy{Frontend: "socks4"}, "Invalid frontend: socks4"},
+		{&Proxy{Frontend: FrontendConnect, CassetteMode: CassetteModeRecord}, "Invalid frontend: can't be used with a cassette"},
+		{&Proxy{Rules: []*Rule{{Host: "db"}}}, "Missing required field: rule name"},
+		{&Proxy{Rules: []*Rule{{Name: "db"}, {Name: "db"}}}, "Duplicate rule name: db"},
+		{&Proxy{Rules: []*Rule{{Name: "db", Host: "[db"}}}, "Invalid rule host: [db"},
+	}
+	for _, c := range cases {
+		err := validateFrontend(c.proxy)
+		if (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("Expected error %q for %+v, got %v", c.err, c.proxy, err)
+		}
+	}
+}
@@ -1,28 +1,98 @@
-package main
+package toxiproxy
 
 import (
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Stores a slice of bytes with its receive timestmap
 type StreamChunk struct {
-	data      []byte
-	timestamp time.Time
+	Data      []byte
+	Timestamp time.Time
+	// The pooled buffer Data points into, nil if Data was allocated elsewhere
+	buffer *chunkBuffer
+}
+
+// Size of the largest pooled buffers, which fits a read by io.Copy
+const chunkBufferSize = 32 * 1024
+
+// Sizes of the pooled buffers. A chunk uses the smallest buffer it fits in, so
+// small chunks held back by a toxic don't pin a whole read's worth of memory.
+var chunkBufferSizes = [...]int{512, 2 * 1024, 8 * 1024, chunkBufferSize}
+
+// A chunkBuffer is a pooled buffer, along with the first chunk pointing into
+// it, so passing data through the toxics doesn't allocate. It's returned to
+// its pool once every chunk pointing into it is released.
+type chunkBuffer struct {
+	chunk StreamChunk
+	data  []byte
+	refs  int32
+	pool  *sync.Pool
+}
+
+// A pool of buffers for each size in chunkBufferSizes
+var chunkBuffers [len(chunkBufferSizes)]sync.Pool
+
+func init() {
+	for i, size := range chunkBufferSizes {
+		pool, size := &chunkBuffers[i], size
+		pool.New = func() interface{} {
+			return &chunkBuffer{data: make([]byte, size), pool: pool}
+		}
+	}
+}
+
+// Returns a chunk with a copy of data, in a pooled buffer if it fits.
+func newStreamChunk(data []byte) *StreamChunk {
+	for i, size := range chunkBufferSizes {
+		if len(data) <= size {
+			buffer := chunkBuffers[i].Get().(*chunkBuffer)
+			buffer.refs = 1
+			n := copy(buffer.data, data)
+			buffer.chunk = StreamChunk{Data: buffer.data[:n], Timestamp: time.Now(), buffer: buffer}
+			return &buffer.chunk
+		}
+	}
+	return &StreamChunk{Data: append([]byte(nil), data...), Timestamp: time.Now()}
+}
+
+// Slice returns a chunk of Data[start:end], sharing the same memory. Toxics
+// that split up chunks should use Slice and then Release the original chunk,
+// so the memory isn't reused while a part of it is still being sent.
+func (c *StreamChunk) Slice(start, end int) *StreamChunk {
+	if c.buffer != nil {
+		atomic.AddInt32(&c.buffer.refs, 1)
+	}
+	return &StreamChunk{Data: c.Data[start:end], Timestamp: c.Timestamp, buffer: c.buffer}
+}
+
+// Release gives up the chunk's memory to be reused, once every chunk sharing
+// it was released. The chunk must not be used afterwards. Chunks that aren't
+// released are garbage collected as usual.
+func (c *StreamChunk) Release() {
+	if c.buffer != nil && atomic.AddInt32(&c.buffer.refs, -1) == 0 {
+		c.buffer.pool.Put(c.buffer)
+	}
 }
 
 // Implements the io.WriteCloser interface for a chan []byte
 type ChanWriter struct {
 	output chan<- *StreamChunk
+	// Optionally called with all data written, used to record traffic.
+	tap func([]byte)
 }
 
 func NewChanWriter(output chan<- *StreamChunk) *ChanWriter {
-	return &ChanWriter{output}
+	return &ChanWriter{output: output}
 }
 
 func (c *ChanWriter) Write(buf []byte) (int, error) {
-	packet := &StreamChunk{make([]byte, len(buf)), time.Now()}
-	copy(packet.data, buf) // Make a copy before sending it to the channel
+	packet := newStreamChunk(buf) // Make a copy before sending it to the channel
+	if c.tap != nil {
+		c.tap(packet.Data)
+	}
 	c.output <- packet
 	return len(buf), nil
 }
@@ -36,13 +106,29 @@ func (c *ChanWriter) Close() error {
 type ChanReader struct {
 	input  <-chan *StreamChunk
 	buffer []byte
+	// The chunk being read from, released once all of it was read
+	chunk *StreamChunk
+	// Optionally called with all data read, used to record traffic.
+	tap func([]byte)
 }
 
 func NewChanReader(input <-chan *StreamChunk) *ChanReader {
-	return &ChanReader{input, []byte{}}
+	return &ChanReader{input: input, buffer: []byte{}}
 }
 
 func (c *ChanReader) Read(out []byte) (int, error) {
+	n, err := c.read(out)
+	if n > 0 && c.tap != nil {
+		c.tap(out[:n])
+	}
+	if len(c.buffer) == 0 && c.chunk != nil {
+		c.chunk.Release()
+		c.chunk = nil
+	}
+	return n, err
+}
+
+func (c *ChanReader) read(out []byte) (int, error) {
 	if c.buffer == nil {
 		return 0, io.EOF
 	}
@@ -58,8 +144,9 @@ func (c *ChanReader) Read(out []byte) (int, error) {
 				c.buffer = nil
 				return n, io.EOF
 			}
-			n2 := copy(out[n:], p.data)
-			c.buffer = p.data[n2:]
+			c.next(p)
+			n2 := copy(out[n:], p.Data)
+			c.buffer = p.Data[n2:]
 			return n + n2, nil
 		default:
 			return n, nil
@@ -70,7 +157,16 @@ func (c *ChanReader) Read(out []byte) (int, error) {
 		c.buffer = nil
 		return 0, io.EOF
 	}
-	n2 := copy(out[n:], p.data)
-	c.buffer = p.data[n2:]
+	c.next(p)
+	n2 := copy(out[n:], p.Data)
+	c.buffer = p.Data[n2:]
 	return n + n2, nil
 }
+
+// Releases the chunk that was read from, which must be empty, before moving on to p.
+func (c *ChanReader) next(p *StreamChunk) {
+	if c.chunk != nil {
+		c.chunk.Release()
+	}
+	c.chunk = p
+}
@@ -1,8 +1,9 @@
-package main
+package toxiproxy
 
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"testing"
 )
 
@@ -152,3 +153,72 @@ func TestMultiWriteWithCopy(t *testing.T) {
 		t.Fatal("Got wrong message from stream", buf.String())
 	}
 }
+
+func TestChunkSliceRelease(t *testing.T) {
+	chunk := newStreamChunk([]byte("hello world"))
+	if chunk.buffer == nil {
+		t.Fatal("Expected small chunk to use a pooled buffer")
+	}
+	buffer := chunk.buffer
+
+	hello := chunk.Slice(0, 5)
+	world := chunk.Slice(6, 11)
+	chunk.Release()
+	if string(hello.Data) != "hello" || string(world.Data) != "world" {
+		t.Fatalf("Slices contained wrong data: %q %q", hello.Data, world.Data)
+	}
+
+	hello.Release()
+	if buffer.refs != 1 {
+		t.Fatal("Expected buffer to be referenced by the remaining slice, got", buffer.refs)
+	}
+	world.Release()
+	if buffer.refs != 0 {
+		t.Fatal("Expected buffer to be released, got", buffer.refs)
+	}
+}
+
+func TestChunkBufferSizes(t *testing.T) {
+	// Chunks use the smallest pooled buffer they fit in
+	sizes := map[int]int{1: 512, 512: 512, 513: 2048, 5000: 8192, chunkBufferSize: chunkBufferSize}
+	for size, expected := range sizes {
+		chunk := newStreamChunk(make([]byte, size))
+		if len(chunk.Data) != size || len(chunk.buffer.data) != expected {
+			t.Errorf("Expected a %d byte chunk to use a %d byte buffer, got %d", size, expected, len(chunk.buffer.data))
+		}
+		chunk.Release()
+	}
+}
+
+func TestLargeChunkNotPooled(t *testing.T) {
+	data := make([]byte, chunkBufferSize+1)
+	chunk := newStreamChunk(data)
+	if chunk.buffer != nil || len(chunk.Data) != len(data) {
+		t.Fatal("Expected large chunk to be allocated outside of the pool")
+	}
+	chunk.Slice(0, 10).Release()
+	chunk.Release()
+}
+
+func TestReaderReleasesChunks(t *testing.T) {
+	first := newStreamChunk([]byte("hello "))
+	second := newStreamChunk([]byte("world"))
+	c := make(chan *StreamChunk, 3)
+	c <- first
+	c <- second
+	c <- nil
+	reader := NewChanReader(c)
+
+	buf := make([]byte, 3)
+	reader.Read(buf)
+	if first.buffer.refs != 1 {
+		t.Fatal("Expected partly read chunk not to be released")
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil || string(data) != "lo world" {
+		t.Fatalf("Read wrong data from stream: %q %v", data, err)
+	}
+	if first.buffer.refs != 0 || second.buffer.refs != 0 {
+		t.Fatal("Expected chunks to be released once read")
+	}
+}
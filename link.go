@@ -1,7 +1,10 @@
-package main
+package toxiproxy
 
 import (
 	"io"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -16,18 +19,44 @@ import (
 // Input > ToxicStub > ToxicStub > ToxicStub > Output
 //
 type ToxicLink struct {
+	sync.Mutex
+
 	stubs  []*ToxicStub
 	proxy  *Proxy
 	toxics *ToxicCollection
 	input  *ChanWriter
 	output *ChanReader
+	// Closed once the link is done writing to its destination
+	done chan struct{}
+
+	name          string
+	source        io.Reader
+	dest          io.WriteCloser
+	before, after *recorderTap
+	state         int
+	// Closed once nothing is splicing the connections, so the toxics can use
+	// them. Closed right away if the link never spliced.
+	spliced chan struct{}
 }
 
+// States of a ToxicLink
+const (
+	// Running data through the chain of toxics
+	linkPiping = iota
+	// Copying data straight from the source to the destination, since every
+	// toxic is disabled
+	linkSplicing
+	// Finished while splicing, without ever running the toxics
+	linkSpliced
+)
+
 func NewToxicLink(proxy *Proxy, toxics *ToxicCollection) *ToxicLink {
 	link := &ToxicLink{
-		stubs:  make([]*ToxicStub, len(toxics.chain)),
-		proxy:  proxy,
-		toxics: toxics,
+		stubs:   make([]*ToxicStub, len(toxics.chain)),
+		proxy:   proxy,
+		toxics:  toxics,
+		done:    make(chan struct{}),
+		spliced: make(chan struct{}),
 	}
 
 	// Initialize the link with ToxicStubs
@@ -42,10 +71,41 @@ func NewToxicLink(proxy *Proxy, toxics *ToxicCollection) *ToxicLink {
 	return link
 }
 
-// Start the link with the specified toxics
+// Start the link with the specified toxics. If every toxic is disabled, data is
+// copied straight from source to dest until a toxic is enabled, which lets the
+// kernel splice TCP connections together. Assumes the collection's lock has
+// already been taken.
 func (link *ToxicLink) Start(name string, source io.Reader, dest io.WriteCloser) {
+	link.name = name
+	link.source = source
+	link.dest = dest
+
+	// Tap the data before and after the toxics, in case the proxy is recording
+	if conn, ok := source.(net.Conn); ok {
+		link.before = link.proxy.recorder.Tap(conn.RemoteAddr(), conn.LocalAddr(), "before toxics")
+		link.input.tap = link.before.Write
+	}
+	if conn, ok := dest.(net.Conn); ok {
+		link.after = link.proxy.recorder.Tap(conn.LocalAddr(), conn.RemoteAddr(), "after toxics")
+		link.output.tap = link.after.Write
+	}
+
+	if conn, ok := source.(net.Conn); ok && link.toxics.allNoop() && !link.proxy.recorder.recording() {
+		link.state = linkSplicing
+		go link.splice(conn)
+		return
+	}
+	link.state = linkPiping
+	close(link.spliced)
+	link.pipe()
+}
+
+// Runs data from the source through the toxics to the destination. The toxics
+// start right away, but data is only copied once splicing stopped.
+func (link *ToxicLink) pipe() {
 	go func() {
-		bytes, err := io.Copy(link.input, source)
+		<-link.spliced
+		bytes, err := io.Copy(link.input, link.source)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"name":     link.proxy.Name,
@@ -55,12 +115,14 @@ func (link *ToxicLink) Start(name string, source io.Reader, dest io.WriteCloser)
 			}).Warn("Source terminated")
 		}
 		link.input.Close()
+		link.before.Close()
 	}()
 	for i, toxic := range link.toxics.chain {
 		go link.stubs[i].Run(toxic)
 	}
 	go func() {
-		bytes, err := io.Copy(dest, link.output)
+		<-link.spliced
+		bytes, err := io.Copy(link.dest, link.output)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"name":     link.proxy.Name,
@@ -69,15 +131,95 @@ func (link *ToxicLink) Start(name string, source io.Reader, dest io.WriteCloser)
 				"err":      err,
 			}).Warn("Destination terminated")
 		}
-		dest.Close()
-		link.toxics.RemoveLink(name)
-		link.proxy.RemoveConnection(name)
+		link.after.Close()
+		link.toxics.RemoveLink(link.name)
+		defer close(link.done)
+
+		// Only send a FIN if a toxic half closed the link, the other direction
+		// is still using the connection.
+		if conn, ok := link.dest.(interface {
+			CloseWrite() error
+		}); ok && link.halfClosed() && conn.CloseWrite() == nil {
+			return
+		}
+		link.dest.Close()
+		link.proxy.RemoveConnection(link.name)
 	}()
 }
 
+// Copies data straight from the source to the destination, until the source
+// closes or stopSplicing() interrupts the copy with a read deadline. Between
+// two TCP connections, io.Copy uses splice(2) on Linux, so the data never
+// leaves the kernel.
+func (link *ToxicLink) splice(source net.Conn) {
+	bytes, err := io.Copy(link.dest, source)
+
+	link.Lock()
+	if link.state == linkPiping {
+		// Every byte read was written, so the toxics carry on where this left off
+		link.Unlock()
+		source.SetReadDeadline(time.Time{})
+		close(link.spliced)
+		return
+	}
+	link.state = linkSpliced
+	link.Unlock()
+
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"name":     link.proxy.Name,
+			"upstream": link.proxy.Upstream,
+			"bytes":    bytes,
+			"err":      err,
+		}).Warn("Spliced connection terminated")
+	}
+	link.before.Close()
+	link.after.Close()
+	link.toxics.RemoveLink(link.name)
+	link.dest.Close()
+	link.proxy.RemoveConnection(link.name)
+	close(link.done)
+}
+
+// Moves the link from splicing to running the toxics, without losing or
+// reordering any data. Returns the state the link was in. Assumes the
+// collection's lock has already been taken.
+//
+// The copy being spliced stops at the read deadline, but can be stuck writing
+// to a slow destination, so this doesn't wait for it. The toxics start right
+// away, and get data once the copy stopped.
+func (link *ToxicLink) stopSplicing() int {
+	link.Lock()
+	state := link.state
+	if state == linkSplicing {
+		link.state = linkPiping
+		link.source.(net.Conn).SetReadDeadline(time.Now())
+	}
+	link.Unlock()
+
+	if state == linkSplicing {
+		link.pipe()
+	}
+	return state
+}
+
+// Returns true if a toxic closed the link with CloseWrite(). Only valid once
+// all data has been read from the link's output.
+func (link *ToxicLink) halfClosed() bool {
+	for _, stub := range link.stubs {
+		if stub.halfClosed {
+			return true
+		}
+	}
+	return false
+}
+
 // Replace the toxic at the specified index
 func (link *ToxicLink) SetToxic(toxic Toxic, index int) {
-	if link.stubs[index].Interrupt() {
+	if link.stopSplicing() != linkPiping {
+		return // The toxics were started with the new one, or the link is done
+	}
+	if link.stubs[index].InterruptToxic() {
 		go link.stubs[index].Run(toxic)
 	}
 }
@@ -0,0 +1,91 @@
+package toxiproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The most addresses a proxy can listen on.
+const maxListeners = 1024
+
+// Returns whether the address is a comma separated list of addresses, or has a
+// port range such as localhost:21000-21010.
+func isAddressList(address string) bool {
+	if strings.Contains(address, ",") {
+		return true
+	}
+	return strings.Contains(address[strings.LastIndex(address, ":")+1:], "-")
+}
+
+// Expands a comma separated list of addresses with optional port ranges into
+// one address per port.
+func expandAddresses(list string) ([]string, error) {
+	var addrs []string
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address: %s", address)
+		}
+
+		bounds := strings.SplitN(port, "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 16)
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 16)
+		}
+		if err != nil || last < first {
+			return nil, fmt.Errorf("Invalid port range: %s", address)
+		}
+		if len(addrs)+int(last-first) >= maxListeners {
+			return nil, fmt.Errorf("Too many addresses, the limit is %d", maxListeners)
+		}
+		for p := first; p <= last; p++ {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(p))))
+		}
+	}
+	return addrs, nil
+}
+
+// Returns the addresses the proxy listens on, and the upstream of the clients
+// of each. An upstream list maps to the listen addresses in order, while a
+// single upstream is shared by all of them.
+func listenUpstreams(proxy *Proxy) ([]string, []string, error) {
+	listens := []string{proxy.Listen}
+	if isAddressList(proxy.Listen) {
+		var err error
+		listens, err = expandAddresses(proxy.Listen)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid listen: %s", err)
+		}
+	}
+
+	upstreams := make([]string, len(listens))
+	if !isAddressList(proxy.Upstream) || IsMockUpstream(proxy.Upstream) || IsSRVUpstream(proxy.Upstream) {
+		for i := range upstreams {
+			upstreams[i] = proxy.Upstream
+		}
+		return listens, upstreams, nil
+	}
+
+	if proxy.CassetteMode != "" {
+		return nil, nil, errors.New("Invalid upstream: a list can't be used with a cassette")
+	}
+	upstreams, err := expandAddresses(proxy.Upstream)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid upstream: %s", err)
+	}
+	if len(upstreams) != len(listens) {
+		return nil, nil, fmt.Errorf("Invalid upstream: %d addresses for %d listen addresses", len(upstreams), len(listens))
+	}
+	return listens, upstreams, nil
+}
+
+// validateListen checks the listen and upstream addresses of a proxy.
+func validateListen(proxy *Proxy) error {
+	_, _, err := listenUpstreams(proxy)
+	return err
+}
@@ -0,0 +1,192 @@
+package toxiproxy
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandAddresses(t *testing.T) {
+	addrs, err := expandAddresses("localhost:21000-21002, 127.0.0.1:80")
+	if err != nil {
+		t.Fatal("Failed to expand addresses", err)
+	}
+	expected := "localhost:21000,localhost:21001,localhost:21002,127.0.0.1:80"
+	if strings.Join(addrs, ",") != expected {
+		t.Fatalf("Expected %s, got %s", expected, addrs)
+	}
+
+	invalid := []string{"localhost", "localhost:21002-21000", "localhost:1-70000", "localhost:a-b", "localhost:1-2000"}
+	for _, list := range invalid {
+		if _, err := expandAddresses(list); err == nil {
+			t.Errorf("Expected error expanding %s", list)
+		}
+	}
+}
+
+func TestListenUpstreams(t *testing.T) {
+	cases := []struct {
+		listen, upstream string
+		upstreams        string
+		err              bool
+	}{
+		{"localhost:0", "localhost:3306", "localhost:3306", false},
+		{"", "localhost:3306", "localhost:3306", false},
+		{"localhost:21000-21001", "ftp:31000-31001", "ftp:31000,ftp:31001", false},
+		{"localhost:21000,localhost:21005", "ftp:31000,ftp:31005", "ftp:31000,ftp:31005", false},
+		{"localhost:21000-21001", "ftp:21", "ftp:21,ftp:21", false},
+		{"localhost:21000-21001", "mock://echo", "mock://echo,mock://echo", false},
+		{"localhost:21000-21001", "ftp:31000-31002", "", true},
+		{"localhost:21000", "ftp:31000-31001", "", true},
+		{"localhost:21000-", "ftp:21", "", true},
+	}
+	for _, c := range cases {
+		proxy := &Proxy{Listen: c.listen, Upstream: c.upstream}
+		_, upstreams, err := listenUpstreams(proxy)
+		if c.err {
+			if err == nil {
+				t.Errorf("Expected error for listen %s and upstream %s", c.listen, c.upstream)
+			}
+		} else if err != nil || strings.Join(upstreams, ",") != c.upstreams {
+			t.Errorf("Expected upstreams %s for listen %s, got %s: %v", c.upstreams, c.listen, upstreams, err)
+		}
+	}
+
+	proxy := &Proxy{Listen: "localhost:0,localhost:0", Upstream: "a:1,b:2", CassetteMode: CassetteModeRecord}
+	if err := validateListen(proxy); err == nil {
+		t.Error("Expected error using an upstream list with a cassette")
+	}
+}
+
+func TestProxyMultipleListeners(t *testing.T) {
+	WithTCPServer(t, func(first string, firstResponse chan []byte) {
+		WithTCPServer(t, func(second string, secondResponse chan []byte) {
+			proxy := NewTestProxy("test", first+","+second)
+			proxy.Listen = "localhost:0,localhost:0"
+			proxy.Start()
+			defer proxy.Stop()
+
+			listens := strings.Split(proxy.Listen, ",")
+			if len(listens) != 2 || strings.HasSuffix(listens[0], ":0") || listens[0] == listens[1] {
+				t.Fatal("Expected proxy to listen on 2 bound addresses, got", proxy.Listen)
+			}
+
+			conn := AssertProxyUp(t, listens[1], true)
+			conn.Write([]byte("second"))
+			conn.Close()
+			conn = AssertProxyUp(t, listens[0], true)
+			conn.Write([]byte("first"))
+			conn.Close()
+
+			if resp := <-firstResponse; string(resp) != "first" {
+				t.Fatalf("Expected first upstream to receive first, got %q", resp)
+			}
+			if resp := <-secondResponse; string(resp) != "second" {
+				t.Fatalf("Expected second upstream to receive second, got %q", resp)
+			}
+		})
+	})
+}
+
+func TestProxyMultipleListenersShareToxics(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.Listen = "localhost:0,localhost:0"
+	proxy.Start()
+	defer proxy.Stop()
+
+	proxy.AddToxic("downstream", &LatencyToxic{Latency: 100})
+	for _, listen := range strings.Split(proxy.Listen, ",") {
+		conn := AssertProxyUp(t, listen, true)
+		start := time.Now()
+		if reply, err := Echo(conn, "hello", time.Second); reply != "hello" {
+			t.Fatal("Expected client to be echoed:", err)
+		}
+		if time.Since(start) < 100*time.Millisecond {
+			t.Fatal("Expected the toxic to apply to clients of", listen)
+		}
+		conn.Close()
+	}
+
+	proxy.Stop()
+	for _, listen := range strings.Split(proxy.Listen, ",") {
+		AssertProxyUp(t, listen, false)
+	}
+}
+
+func TestProxyMultipleListenersQueue(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.Listen = "localhost:0,localhost:0"
+	proxy.MaxConnections = 1
+	proxy.QueueConnections = true
+	proxy.Start()
+	defer proxy.Stop()
+	listens := strings.Split(proxy.Listen, ",")
+
+	first := AssertProxyUp(t, listens[0], true)
+	if reply, err := Echo(first, "one", time.Second); reply != "one" {
+		t.Fatal("Expected first client to be let in:", err)
+	}
+
+	// Queue a client on each listener, the second one arriving last
+	queued := make([]net.Conn, 2)
+	for i, listen := range []string{listens[1], listens[0]} {
+		queued[i] = AssertProxyUp(t, listen, true)
+		defer queued[i].Close()
+		if _, err := Echo(queued[i], "queued", 100*time.Millisecond); err == nil {
+			t.Fatal("Expected client over the limit to be queued")
+		}
+	}
+
+	// Each client that leaves lets the one that's been waiting longest in
+	first.Close()
+	AssertEchoed(t, queued[0], "queued")
+	queued[1].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := queued[1].Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the client that arrived last to still be queued")
+	}
+	queued[0].Close()
+	AssertEchoed(t, queued[1], "queued")
+}
+
+func TestProxyMultipleListenersRaiseMaxConnections(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.Listen = "localhost:0,localhost:0"
+	proxy.MaxConnections = 1
+	proxy.QueueConnections = true
+	proxy.Start()
+	defer proxy.Stop()
+	listens := strings.Split(proxy.Listen, ",")
+
+	first := AssertProxyUp(t, listens[0], true)
+	defer first.Close()
+	Echo(first, "one", time.Second)
+	var queued []net.Conn
+	for _, listen := range listens {
+		conn := AssertProxyUp(t, listen, true)
+		defer conn.Close()
+		conn.Write([]byte("queued"))
+		queued = append(queued, conn)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Every listener's queued client is woken up, not just one of them
+	err := proxy.Update(&Proxy{Listen: proxy.Listen, Upstream: proxy.Upstream, Enabled: true, MaxConnections: 3})
+	if err != nil {
+		t.Fatal("Failed to update proxy", err)
+	}
+	for _, conn := range queued {
+		AssertEchoed(t, conn, "queued")
+	}
+}
+
+// Asserts the client was sent data, written before it was let in.
+func AssertEchoed(t *testing.T, conn net.Conn, data string) {
+	buf := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(conn, buf)
+	if err != nil || string(buf) != data {
+		t.Fatalf("Expected client to be let in and sent %q, got %q: %v", data, buf, err)
+	}
+}
@@ -0,0 +1,184 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A MockUpstream is a synthetic upstream built into toxiproxy, selected with
+// an upstream address such as mock://echo. Instead of dialing a server, the
+// proxy serves the connection itself on one end of a pipe, so mocks go through
+// the same toxics as any other upstream.
+//
+//  - mock://echo sends back everything it receives
+//  - mock://blackhole accepts data and never responds
+//  - mock://static?body=hello sends a fixed body, and closes if close=true
+//  - mock://http?status=500 responds to HTTP requests, with an optional body
+//  - mock://garbage?size=1024 sends random bytes
+//
+type MockUpstream struct {
+	Kind   string
+	Body   []byte
+	Close  bool
+	Status int
+	Size   int
+}
+
+const mockScheme = "mock://"
+
+func IsMockUpstream(upstream string) bool {
+	return strings.HasPrefix(upstream, mockScheme)
+}
+
+// ParseMockUpstream parses a mock:// upstream address and its parameters.
+func ParseMockUpstream(upstream string) (*MockUpstream, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+
+	mock := &MockUpstream{
+		Kind:   u.Host,
+		Body:   []byte(query.Get("body")),
+		Status: http.StatusOK,
+		Size:   1024,
+	}
+
+	if query.Get("close") != "" {
+		mock.Close, err = strconv.ParseBool(query.Get("close"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid mock upstream close: %s", query.Get("close"))
+		}
+	}
+	if query.Get("status") != "" {
+		mock.Status, err = strconv.Atoi(query.Get("status"))
+		if err != nil || mock.Status < 100 || mock.Status > 999 {
+			return nil, fmt.Errorf("Invalid mock upstream status: %s", query.Get("status"))
+		}
+	}
+	if query.Get("size") != "" {
+		mock.Size, err = strconv.Atoi(query.Get("size"))
+		if err != nil || mock.Size < 0 {
+			return nil, fmt.Errorf("Invalid mock upstream size: %s", query.Get("size"))
+		}
+	}
+
+	switch mock.Kind {
+	case "echo", "blackhole", "static", "http", "garbage":
+		return mock, nil
+	default:
+		return nil, fmt.Errorf("Unknown mock upstream: %s", mock.Kind)
+	}
+}
+
+// Dial returns a connection to a new instance of the mock.
+func (m *MockUpstream) Dial() net.Conn {
+	local, remote := halfClosePipe()
+	go m.serve(remote)
+	return local
+}
+
+func (m *MockUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+
+	switch m.Kind {
+	case "echo":
+		io.Copy(conn, conn)
+		return
+	case "static":
+		_, err := conn.Write(m.Body)
+		if err != nil || m.Close {
+			return
+		}
+	case "http":
+		m.serveHTTP(conn)
+		return
+	case "garbage":
+		garbage := make([]byte, m.Size)
+		for i := range garbage {
+			garbage[i] = byte(rand.Intn(256))
+		}
+		_, err := conn.Write(garbage)
+		if err != nil {
+			return
+		}
+	}
+
+	// Wait for the client to close the connection
+	io.Copy(ioutil.Discard, conn)
+}
+
+func (m *MockUpstream) serveHTTP(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, request.Body)
+		request.Body.Close()
+
+		response := &http.Response{
+			StatusCode:    m.Status,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Request:       request,
+			Header:        make(http.Header),
+			Body:          ioutil.NopCloser(bytes.NewReader(m.Body)),
+			ContentLength: int64(len(m.Body)),
+			Close:         request.Close,
+		}
+		err = response.Write(conn)
+		if err != nil || request.Close {
+			return
+		}
+	}
+}
+
+// Returns the two ends of a pipe like net.Pipe(), which can also be half
+// closed. Each direction is its own pipe, so closing the write side of one end
+// only makes reads from the other end return io.EOF.
+func halfClosePipe() (net.Conn, net.Conn) {
+	aRead, bWrite := net.Pipe()
+	bRead, aWrite := net.Pipe()
+	return &pipeConn{aRead, aWrite}, &pipeConn{bRead, bWrite}
+}
+
+// A pipeConn reads from one pipe and writes to another.
+type pipeConn struct {
+	net.Conn // The read side
+	write    net.Conn
+}
+
+func (c *pipeConn) Write(buf []byte) (int, error) {
+	return c.write.Write(buf)
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.Conn.SetDeadline(t)
+	return c.write.SetDeadline(t)
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return c.write.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) CloseWrite() error {
+	return c.write.Close()
+}
+
+func (c *pipeConn) Close() error {
+	c.write.Close()
+	return c.Conn.Close()
+}
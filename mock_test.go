@@ -0,0 +1,158 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func WithMockProxy(t *testing.T, upstream string, f func(conn net.Conn, proxy *Proxy)) {
+	proxy := NewTestProxy("mock", upstream)
+	err := proxy.Start()
+	if err != nil {
+		t.Fatal("Failed to start mock proxy", err)
+	}
+	defer proxy.Stop()
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial mock proxy", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	f(conn, proxy)
+}
+
+func TestParseMockUpstream(t *testing.T) {
+	valid := []string{
+		"mock://echo",
+		"mock://blackhole",
+		"mock://static?body=hello&close=true",
+		"mock://http?status=500&body=oops",
+		"mock://garbage?size=10",
+	}
+	for _, upstream := range valid {
+		_, err := ParseMockUpstream(upstream)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", upstream, err)
+		}
+	}
+
+	invalid := []string{
+		"mock://unknown",
+		"mock://static?close=maybe",
+		"mock://http?status=abc",
+		"mock://garbage?size=-1",
+	}
+	for _, upstream := range invalid {
+		_, err := ParseMockUpstream(upstream)
+		if err == nil {
+			t.Errorf("Expected error parsing %s", upstream)
+		}
+	}
+}
+
+func TestMockEcho(t *testing.T) {
+	WithMockProxy(t, "mock://echo", func(conn net.Conn, proxy *Proxy) {
+		proxy.downToxics.SetToxicValue(&LatencyToxic{Enabled: true, Latency: 100})
+
+		start := time.Now()
+		msg := []byte("hello world\n")
+		conn.Write(msg)
+		buf := make([]byte, len(msg))
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal("Failed to read from echo mock", err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Errorf("Echo mock sent wrong data: %q", buf)
+		}
+		AssertDeltaTime(t, "Echo latency", time.Since(start), 100*time.Millisecond, 20*time.Millisecond)
+	})
+}
+
+func TestHalfClosePipe(t *testing.T) {
+	local, remote := halfClosePipe()
+	defer remote.Close()
+	// Cassettes half close the upstream they're recording too
+	conn := new(Cassette).Record(local).(interface {
+		net.Conn
+		CloseWrite() error
+	})
+	defer local.Close()
+
+	go func() {
+		conn.Write([]byte("hello"))
+		conn.CloseWrite()
+	}()
+	data, err := ioutil.ReadAll(remote)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Expected to read until the write side was closed, got %q, %v", data, err)
+	}
+
+	// The other direction stays open
+	go remote.Write([]byte("world"))
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "world" {
+		t.Fatalf("Expected to read from the half closed pipe, got %q, %v", buf, err)
+	}
+}
+
+func TestMockBlackhole(t *testing.T) {
+	WithMockProxy(t, "mock://blackhole", func(conn net.Conn, proxy *Proxy) {
+		conn.Write([]byte("hello world\n"))
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Error("Expected blackhole mock to never respond", err)
+		}
+	})
+}
+
+func TestMockStatic(t *testing.T) {
+	WithMockProxy(t, "mock://static?body=220+ready&close=true", func(conn net.Conn, proxy *Proxy) {
+		data, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatal("Failed to read from static mock", err)
+		}
+		if string(data) != "220 ready" {
+			t.Errorf("Static mock sent wrong data: %q", data)
+		}
+	})
+}
+
+func TestMockHTTP(t *testing.T) {
+	WithMockProxy(t, "mock://http?status=500&body=oops", func(conn net.Conn, proxy *Proxy) {
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			request, _ := http.NewRequest("GET", "http://"+proxy.Listen+"/", nil)
+			request.Write(conn)
+
+			response, err := http.ReadResponse(reader, request)
+			if err != nil {
+				t.Fatal("Failed to read response from HTTP mock", err)
+			}
+			body, _ := ioutil.ReadAll(response.Body)
+			if response.StatusCode != 500 || string(body) != "oops" {
+				t.Errorf("HTTP mock sent wrong response: %d %q", response.StatusCode, body)
+			}
+		}
+	})
+}
+
+func TestMockGarbage(t *testing.T) {
+	WithMockProxy(t, "mock://garbage?size=100", func(conn net.Conn, proxy *Proxy) {
+		_, err := io.ReadFull(conn, make([]byte, 100))
+		if err != nil {
+			t.Error("Failed to read from garbage mock", err)
+		}
+	})
+}
@@ -1,8 +1,13 @@
-package main
+package toxiproxy
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"gopkg.in/tomb.v1"
@@ -24,12 +29,55 @@ type Proxy struct {
 	Upstream string `json:"upstream"`
 	Enabled  bool   `json:"enabled"`
 
+	// Record the upstream to, or replay it from a cassette file
+	Cassette      string `json:"cassette,omitempty"`
+	CassetteMode  string `json:"cassette_mode,omitempty"`
+	CassetteMatch string `json:"cassette_match,omitempty"`
+
+	// Limits on clients, 0 for no limit. Clients over MaxConnections are closed
+	// right away, or queued until another client disconnects with
+	// QueueConnections. AcceptRate is the number of clients let in per second.
+	MaxConnections   int     `json:"max_connections,omitempty"`
+	QueueConnections bool    `json:"queue_connections,omitempty"`
+	AcceptRate       float64 `json:"accept_rate,omitempty"`
+
+	// With the connect frontend, clients pick their destination with SOCKS5 or
+	// HTTP CONNECT instead of going to Upstream, and rules pick their toxics
+	Frontend string  `json:"frontend,omitempty"`
+	Rules    []*Rule `json:"rules,omitempty"`
+
+	// Clients start with a PROXY protocol header carrying their real address,
+	// and the upstream is sent one in the given version
+	AcceptProxyProtocol bool   `json:"accept_proxy_protocol,omitempty"`
+	SendProxyProtocol   string `json:"send_proxy_protocol,omitempty"`
+
 	started chan error
 
+	// Guarded by the connections lock, like the limits once the proxy started
+	clients  int
+	admitted time.Time
+	// Clients waiting to be let in by the limits, in the order they arrived
+	queued []net.Conn
+	// Closed and replaced when a client disconnects, is let in, or the limits
+	// change, waking every queued client
+	freed    chan struct{}
+	rejected int64
+	// Closed when the accept loop is resumed, nil while it isn't paused
+	resumed   chan struct{}
+	listeners []*net.TCPListener
+
+	resolver      *Resolver
+	resolveErrors int64
+	dialErrors    int64
+	// Clients whose upstream is being dialed
+	connecting sync.WaitGroup
+
 	tomb        tomb.Tomb
 	connections ConnectionList
 	upToxics    *ToxicCollection
 	downToxics  *ToxicCollection
+	recorder    *Recorder
+	cassette    *Cassette
 }
 
 type ConnectionList struct {
@@ -51,9 +99,13 @@ func NewProxy() *Proxy {
 	proxy := &Proxy{
 		started:     make(chan error),
 		connections: ConnectionList{list: make(map[string]net.Conn)},
+		freed:       make(chan struct{}),
+		resolver:    DefaultResolver,
+		recorder:    NewRecorder(),
 	}
 	proxy.upToxics = NewToxicCollection(proxy)
 	proxy.downToxics = NewToxicCollection(proxy)
+	proxy.downToxics.downstream = true
 	return proxy
 }
 
@@ -68,12 +120,29 @@ func (proxy *Proxy) Update(input *Proxy) error {
 	proxy.Lock()
 	defer proxy.Unlock()
 
-	if input.Listen != proxy.Listen || input.Upstream != proxy.Upstream {
+	if input.Listen != proxy.Listen || input.Upstream != proxy.Upstream ||
+		input.Cassette != proxy.Cassette || input.CassetteMode != proxy.CassetteMode ||
+		input.CassetteMatch != proxy.CassetteMatch || input.Frontend != proxy.Frontend ||
+		input.AcceptProxyProtocol != proxy.AcceptProxyProtocol || input.SendProxyProtocol != proxy.SendProxyProtocol {
 		stop(proxy)
 		proxy.Listen = input.Listen
 		proxy.Upstream = input.Upstream
+		proxy.Frontend = input.Frontend
+		proxy.AcceptProxyProtocol = input.AcceptProxyProtocol
+		proxy.SendProxyProtocol = input.SendProxyProtocol
+		proxy.Cassette = input.Cassette
+		proxy.CassetteMode = input.CassetteMode
+		proxy.CassetteMatch = input.CassetteMatch
 	}
 
+	proxy.connections.Lock()
+	proxy.MaxConnections = input.MaxConnections
+	proxy.QueueConnections = input.QueueConnections
+	proxy.AcceptRate = input.AcceptRate
+	proxy.signalFreed() // Let queued clients in if the limits were raised
+	proxy.connections.Unlock()
+	proxy.setRules(input.Rules)
+
 	if input.Enabled != proxy.Enabled {
 		if input.Enabled {
 			return start(proxy)
@@ -90,16 +159,94 @@ func (proxy *Proxy) Stop() {
 	stop(proxy)
 }
 
-// server runs the Proxy server, accepting new clients and creating Links to
-// connect them to upstreams.
+// AddToxic enables toxic in the direction, replacing the toxic of the same type.
+func (proxy *Proxy) AddToxic(direction string, toxic Toxic) error {
+	toxics, err := proxy.toxics(direction)
+	if err != nil {
+		return err
+	}
+	toxic.SetEnabled(true)
+	return toxics.SetToxicValue(toxic)
+}
+
+// AddRuleToxic enables toxic in the direction for clients matching the rule
+// with the given name, replacing the toxic of the same type.
+func (proxy *Proxy) AddRuleToxic(rule, direction string, toxic Toxic) error {
+	toxics, err := proxy.ruleToxics(rule, direction)
+	if err != nil {
+		return err
+	}
+	toxic.SetEnabled(true)
+	return toxics.SetToxicValue(toxic)
+}
+
+// RemoveToxic disables the toxic with the given name in the direction.
+func (proxy *Proxy) RemoveToxic(direction string, name string) error {
+	toxics, err := proxy.toxics(direction)
+	if err != nil {
+		return err
+	}
+	return toxics.DisableToxic(name)
+}
+
+func (proxy *Proxy) toxics(direction string) (*ToxicCollection, error) {
+	switch direction {
+	case Upstream:
+		return proxy.upToxics, nil
+	case Downstream:
+		return proxy.downToxics, nil
+	}
+	return nil, fmt.Errorf("Invalid toxic direction: %s", direction)
+}
+
+// Starts, stops or moves the recording. Connections with every toxic disabled
+// bypass the toxics, so they're moved back onto the toxics to be recorded.
+func (proxy *Proxy) updateRecorder(enabled bool, path string) error {
+	err := proxy.recorder.Update(enabled, path)
+	if err == nil && enabled {
+		proxy.upToxics.StopSplicing()
+		proxy.downToxics.StopSplicing()
+		for _, toxics := range proxy.allRuleToxics() {
+			toxics.StopSplicing()
+		}
+	}
+	return err
+}
+
+// Returns whether the proxy forwards datagrams rather than a stream. Proxies
+// only listen on TCP so far, so datagram toxics can't be enabled yet.
+func (proxy *Proxy) datagram() bool {
+	return false
+}
+
+// server runs the Proxy server, accepting new clients on each of its listen
+// addresses and creating Links to connect them to upstreams.
 func (proxy *Proxy) server() {
-	ln, err := net.Listen("tcp", proxy.Listen)
+	listens, upstreams, err := listenUpstreams(proxy)
 	if err != nil {
 		proxy.started <- err
 		return
 	}
 
-	proxy.Listen = ln.Addr().String()
+	var listeners []*net.TCPListener
+	var bound []string
+	for _, listen := range listens {
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			proxy.started <- err
+			return
+		}
+		listeners = append(listeners, ln.(*net.TCPListener))
+		bound = append(bound, ln.Addr().String())
+	}
+
+	proxy.Listen = strings.Join(bound, ",")
+	proxy.connections.Lock()
+	proxy.listeners = listeners
+	proxy.connections.Unlock()
 	proxy.started <- nil
 
 	logrus.WithFields(logrus.Fields{
@@ -111,30 +258,57 @@ func (proxy *Proxy) server() {
 	acceptTomb := tomb.Tomb{}
 	defer acceptTomb.Done()
 
-	// This channel is to kill the blocking Accept() call below by closing the
-	// net.Listener.
+	// This channel is to kill the blocking Accept() calls below by closing the
+	// listeners.
 	go func() {
 		<-proxy.tomb.Dying()
 
 		// Notify ln.Accept() that the shutdown was safe
 		acceptTomb.Killf("Shutting down from stop()")
+		proxy.connections.Lock()
+		proxy.listeners = nil
+		proxy.connections.Unlock()
 		// Unblock ln.Accept()
-		err := ln.Close()
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"proxy":  proxy.Name,
-				"listen": proxy.Listen,
-				"err":    err,
-			}).Warn("Attempted to close an already closed proxy server")
+		for _, ln := range listeners {
+			err := ln.Close()
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"proxy":  proxy.Name,
+					"listen": ln.Addr(),
+					"err":    err,
+				}).Warn("Attempted to close an already closed proxy server")
+			}
 		}
 
-		// Wait for the accept loop to finish processing
+		// Wait for the accept loops to finish processing
 		acceptTomb.Wait()
 		proxy.tomb.Done()
 	}()
 
+	var accepting sync.WaitGroup
+	for i, ln := range listeners {
+		accepting.Add(1)
+		go func(ln *net.TCPListener, upstream string) {
+			defer accepting.Done()
+			proxy.accept(ln, upstream, &acceptTomb)
+		}(ln, upstreams[i])
+	}
+	accepting.Wait()
+}
+
+// accept runs the accept loop of one of the listeners of the proxy, whose
+// clients are connected to upstream.
+func (proxy *Proxy) accept(ln *net.TCPListener, upstream string, acceptTomb *tomb.Tomb) {
+	dying := proxy.tomb.Dying()
 	for {
+		if !proxy.waitAccepting() {
+			return
+		}
+
 		client, err := ln.Accept()
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			continue // Interrupted by Pause
+		}
 		if err != nil {
 			// This is to confirm we're being shut down in a legit way. Unfortunately,
 			// Go doesn't export the error when it's closed from Close() so we have to
@@ -146,7 +320,7 @@ func (proxy *Proxy) server() {
 			default:
 				logrus.WithFields(logrus.Fields{
 					"proxy":  proxy.Name,
-					"listen": proxy.Listen,
+					"listen": ln.Addr(),
 					"err":    err,
 				}).Warn("Error while accepting client")
 			}
@@ -156,32 +330,365 @@ func (proxy *Proxy) server() {
 		logrus.WithFields(logrus.Fields{
 			"name":     proxy.Name,
 			"client":   client.RemoteAddr(),
-			"proxy":    proxy.Listen,
-			"upstream": proxy.Upstream,
+			"proxy":    ln.Addr(),
+			"upstream": upstream,
 		}).Info("Accepted client")
 
-		upstream, err := net.Dial("tcp", proxy.Upstream)
+		if !proxy.admit(client) {
+			continue
+		}
+
+		proxy.connecting.Add(1)
+		go proxy.connect(client, upstream, dying)
+	}
+}
+
+// connect dials the upstream for the client, and links them together through
+// the toxics. Dialing is given up once dying is closed.
+func (proxy *Proxy) connect(client net.Conn, upstreamAddr string, dying <-chan struct{}) {
+	defer proxy.connecting.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := client
+	go func() {
+		select {
+		case <-dying:
+			cancel()
+			conn.SetDeadline(time.Now()) // Give up reading a header or connect request
+		case <-ctx.Done():
+		}
+	}()
+
+	header := connectionHeader(client)
+	if proxy.AcceptProxyProtocol {
+		client.SetDeadline(time.Now().Add(frontendTimeout))
+		accepted, headerConn, err := readProxyHeader(client)
+		if err != nil {
+			proxy.dropClient(ctx, client, err, "Invalid PROXY protocol header from client")
+			return
+		}
+		header = accepted
+		client.SetDeadline(time.Time{})
+		client = headerConn
+	}
+
+	upToxics, downToxics := proxy.upToxics, proxy.downToxics
+	target := upstreamAddr
+	var request *connectRequest
+	if proxy.Frontend == FrontendConnect {
+		client.SetDeadline(time.Now().Add(frontendTimeout))
+		var err error
+		request, err = readConnectRequest(client)
+		if err != nil {
+			proxy.dropClient(ctx, client, err, "Invalid connect request from client")
+			return
+		}
+		target = request.Destination
+		upToxics, downToxics = proxy.matchRule(target)
+	}
+
+	var upstream net.Conn
+	var err error
+	if request != nil {
+		upstream, err = proxy.dialAddress(ctx, upToxics, target)
+	} else {
+		upstream, err = proxy.dial(ctx, target)
+	}
+	if err == nil && proxy.SendProxyProtocol != "" {
+		_, err = upstream.Write(header.encode(proxy.SendProxyProtocol))
 		if err != nil {
+			upstream.Close()
+		}
+	}
+	if request != nil {
+		request.reply(err)
+		client.SetDeadline(time.Time{})
+		client = request.conn
+	}
+	if err != nil {
+		client.Close()
+		proxy.release()
+		if ctx.Err() != nil {
+			return // The proxy stopped
+		}
+
+		message := "Unable to open connection to upstream"
+		if _, ok := err.(*ResolveError); ok {
+			message = "Unable to resolve upstream"
+			atomic.AddInt64(&proxy.resolveErrors, 1)
+		} else {
+			atomic.AddInt64(&proxy.dialErrors, 1)
+		}
+		logrus.WithFields(logrus.Fields{
+			"name":     proxy.Name,
+			"client":   client.RemoteAddr(),
+			"proxy":    proxy.Listen,
+			"upstream": target,
+			"err":      err,
+		}).Error(message)
+		return
+	}
+
+	name := client.RemoteAddr().String()
+	proxy.connections.Lock()
+	proxy.connections.list[name+"client"] = client
+	proxy.connections.list[name+"upstream"] = upstream
+	proxy.connections.Unlock()
+	up := upToxics.StartLink(name+"client", client, upstream)
+	down := downToxics.StartLink(name+"upstream", upstream, client)
+
+	// Each link closes its destination when it's done, unless it was half
+	// closed, so make sure both are closed once both directions are done.
+	go func() {
+		<-up.done
+		<-down.done
+		client.Close()
+		upstream.Close()
+		proxy.RemoveConnection(name + "client")
+		proxy.RemoveConnection(name + "upstream")
+		proxy.release()
+	}()
+}
+
+// Pause stops accepting clients until the proxy is resumed, while keeping the
+// listener open. New clients fill up the listen backlog of the kernel, then
+// hang in connect.
+func (proxy *Proxy) Pause() {
+	proxy.connections.Lock()
+	defer proxy.connections.Unlock()
+
+	if proxy.resumed != nil {
+		return
+	}
+	proxy.resumed = make(chan struct{})
+	// Interrupt the pending Accept() calls
+	proxy.setDeadlines(time.Now())
+}
+
+// Resume accepts clients again after Pause, letting in any waiting in the
+// listen backlog.
+func (proxy *Proxy) Resume() {
+	proxy.connections.Lock()
+	defer proxy.connections.Unlock()
+
+	if proxy.resumed == nil {
+		return
+	}
+	proxy.setDeadlines(time.Time{})
+	close(proxy.resumed)
+	proxy.resumed = nil
+}
+
+// Sets the deadline of the Accept() calls of every listener. Must be called
+// with the connections lock held.
+func (proxy *Proxy) setDeadlines(deadline time.Time) {
+	for _, ln := range proxy.listeners {
+		ln.SetDeadline(deadline)
+	}
+}
+
+// Paused returns whether the proxy stopped accepting clients with Pause.
+func (proxy *Proxy) Paused() bool {
+	proxy.connections.Lock()
+	defer proxy.connections.Unlock()
+	return proxy.resumed != nil
+}
+
+// Blocks while the proxy is paused. Returns false if the proxy stopped.
+func (proxy *Proxy) waitAccepting() bool {
+	proxy.connections.Lock()
+	resumed := proxy.resumed
+	proxy.connections.Unlock()
+	if resumed == nil {
+		return true
+	}
+
+	select {
+	case <-resumed:
+		return true
+	case <-proxy.tomb.Dying():
+		return false
+	}
+}
+
+// admit waits until the client is let in by the limits of the proxy. Returns
+// false if the client was rejected, or the proxy stopped while it was queued.
+// Each listener waits here with its clients, so queued clients are let in in
+// the order they arrived, whichever address they connected to.
+func (proxy *Proxy) admit(client net.Conn) bool {
+	proxy.connections.Lock()
+	defer proxy.connections.Unlock()
+
+	proxy.queued = append(proxy.queued, client)
+	for {
+		full := proxy.MaxConnections > 0 && proxy.clients >= proxy.MaxConnections
+		var wait time.Duration
+		if proxy.AcceptRate > 0 {
+			wait = time.Until(proxy.admitted.Add(time.Duration(float64(time.Second) / proxy.AcceptRate)))
+		}
+		if proxy.queued[0] == client && !full && wait <= 0 {
+			proxy.clients++
+			proxy.admitted = time.Now()
+			proxy.dequeue(client)
+			return true
+		}
+
+		if full && !proxy.QueueConnections {
+			proxy.dequeue(client)
+			atomic.AddInt64(&proxy.rejected, 1)
 			logrus.WithFields(logrus.Fields{
-				"name":     proxy.Name,
-				"client":   client.RemoteAddr(),
-				"proxy":    proxy.Listen,
-				"upstream": proxy.Upstream,
-			}).Error("Unable to open connection to upstream")
+				"name":   proxy.Name,
+				"client": client.RemoteAddr(),
+				"proxy":  proxy.Listen,
+			}).Info("Rejected client over the connection limit")
 			client.Close()
-			continue
+			return false
 		}
 
-		name := client.RemoteAddr().String()
-		proxy.connections.Lock()
-		proxy.connections.list[name+"client"] = client
-		proxy.connections.list[name+"upstream"] = upstream
+		var throttled <-chan time.Time
+		if !full && wait > 0 {
+			throttled = time.After(wait)
+		}
+		freed := proxy.freed
 		proxy.connections.Unlock()
-		proxy.upToxics.StartLink(name+"client", client, upstream)
-		proxy.downToxics.StartLink(name+"upstream", upstream, client)
+		select {
+		case <-freed:
+		case <-throttled:
+		case <-proxy.tomb.Dying():
+			proxy.connections.Lock()
+			proxy.dequeue(client)
+			client.Close()
+			return false
+		}
+		proxy.connections.Lock()
 	}
 }
 
+// Removes the client from the queue, letting the next one try to get in.
+// Assumes the connections lock has already been taken.
+func (proxy *Proxy) dequeue(client net.Conn) {
+	for i, queued := range proxy.queued {
+		if queued == client {
+			proxy.queued = append(proxy.queued[:i], proxy.queued[i+1:]...)
+			break
+		}
+	}
+	proxy.signalFreed()
+}
+
+// Frees the slot of a client that disconnected.
+func (proxy *Proxy) release() {
+	proxy.connections.Lock()
+	proxy.clients--
+	proxy.signalFreed()
+	proxy.connections.Unlock()
+}
+
+// Wakes every queued client to check the limits again. Assumes the connections
+// lock has already been taken.
+func (proxy *Proxy) signalFreed() {
+	close(proxy.freed)
+	proxy.freed = make(chan struct{})
+}
+
+// Rejected returns the number of clients closed for being over the
+// connection limit.
+func (proxy *Proxy) Rejected() int64 {
+	return atomic.LoadInt64(&proxy.rejected)
+}
+
+// ResolveErrors returns the number of clients closed because the upstream
+// couldn't be looked up.
+func (proxy *Proxy) ResolveErrors() int64 {
+	return atomic.LoadInt64(&proxy.resolveErrors)
+}
+
+// DialErrors returns the number of clients closed because the upstream
+// couldn't be connected to, once it was looked up.
+func (proxy *Proxy) DialErrors() int64 {
+	return atomic.LoadInt64(&proxy.dialErrors)
+}
+
+// validateLimits checks the connection limits of a proxy.
+func validateLimits(proxy *Proxy) error {
+	if proxy.MaxConnections < 0 {
+		return fmt.Errorf("Invalid max_connections: %d", proxy.MaxConnections)
+	}
+	if proxy.AcceptRate < 0 {
+		return fmt.Errorf("Invalid accept_rate: %g", proxy.AcceptRate)
+	}
+	return nil
+}
+
+// Closes a client that didn't send a valid header or connect request.
+func (proxy *Proxy) dropClient(ctx context.Context, client net.Conn, err error, message string) {
+	client.Close()
+	proxy.release()
+	if ctx.Err() != nil {
+		return // The proxy stopped
+	}
+	logrus.WithFields(logrus.Fields{
+		"name":   proxy.Name,
+		"client": client.RemoteAddr(),
+		"proxy":  proxy.Listen,
+		"err":    err,
+	}).Warn(message)
+}
+
+// Looks up the addresses of the upstream, through the toxics acting on lookups.
+func (proxy *Proxy) resolve(ctx context.Context, toxics *ToxicCollection, upstream string) ([]string, error) {
+	lookup := proxy.resolver.resolve
+	for _, toxic := range toxics.resolveToxics() {
+		toxic, next := toxic, lookup
+		lookup = func(ctx context.Context, upstream string) ([]string, error) {
+			return toxic.Resolve(ctx, upstream, next)
+		}
+	}
+	return lookup(ctx, upstream)
+}
+
+// Looks up the upstream through the toxics acting on lookups, and connects to
+// it. Errors looking it up are returned as a *ResolveError.
+func (proxy *Proxy) dialAddress(ctx context.Context, toxics *ToxicCollection, upstream string) (net.Conn, error) {
+	addrs, err := proxy.resolve(ctx, toxics, upstream)
+	if err == nil && len(addrs) == 0 {
+		err = errNoAddresses
+	}
+	if err != nil {
+		return nil, &ResolveError{upstream, err}
+	}
+	return dialAddrs(ctx, addrs)
+}
+
+// dial opens a connection to the upstream, or to the cassette or mock
+// replacing it.
+func (proxy *Proxy) dial(ctx context.Context, address string) (net.Conn, error) {
+	if proxy.CassetteMode == CassetteModeReplay {
+		return proxy.cassette.Replay()
+	}
+
+	var upstream net.Conn
+	if IsMockUpstream(address) {
+		mock, err := ParseMockUpstream(address)
+		if err != nil {
+			return nil, err
+		}
+		upstream = mock.Dial()
+	} else {
+		var err error
+		upstream, err = proxy.dialAddress(ctx, proxy.upToxics, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if proxy.CassetteMode == CassetteModeRecord {
+		return proxy.cassette.Record(upstream), nil
+	}
+	return upstream, nil
+}
+
 func (proxy *Proxy) RemoveConnection(name string) {
 	proxy.connections.Lock()
 	defer proxy.connections.Unlock()
@@ -194,11 +701,25 @@ func start(proxy *Proxy) error {
 		return ErrProxyAlreadyStarted
 	}
 
+	var err error
+	switch proxy.CassetteMode {
+	case CassetteModeRecord:
+		proxy.cassette, err = OpenCassette(proxy.Cassette)
+	case CassetteModeReplay:
+		proxy.cassette, err = LoadCassette(proxy.Cassette, proxy.CassetteMatch)
+	}
+	if err != nil {
+		return err
+	}
+
 	proxy.tomb = tomb.Tomb{} // Reset tomb, from previous starts/stops
 	go proxy.server()
-	err := <-proxy.started
+	err = <-proxy.started
 	// Only enable the proxy if it successfully started
 	proxy.Enabled = err == nil
+	if err != nil && proxy.cassette != nil {
+		proxy.cassette.Close()
+	}
 	return err
 }
 
@@ -211,12 +732,17 @@ func stop(proxy *Proxy) {
 
 	proxy.tomb.Killf("Shutting down from stop()")
 	proxy.tomb.Wait() // Wait until we stop accepting new connections
+	proxy.connecting.Wait()
 
 	proxy.connections.Lock()
 	defer proxy.connections.Unlock()
 	for _, conn := range proxy.connections.list {
 		conn.Close()
 	}
+	// Recorded sessions were saved as their connections closed
+	if proxy.cassette != nil {
+		proxy.cassette.Close()
+	}
 
 	logrus.WithFields(logrus.Fields{
 		"name":     proxy.Name,
@@ -1,4 +1,4 @@
-package main
+package toxiproxy
 
 import (
 	"fmt"
@@ -69,6 +69,7 @@ func (collection *ProxyCollection) Remove(name string) error {
 		return err
 	}
 	proxy.Stop()
+	proxy.recorder.Stop()
 
 	delete(collection.proxies, proxy.Name)
 	return nil
@@ -80,6 +81,7 @@ func (collection *ProxyCollection) Clear() error {
 
 	for _, proxy := range collection.proxies {
 		proxy.Stop()
+		proxy.recorder.Stop()
 
 		delete(collection.proxies, proxy.Name)
 	}
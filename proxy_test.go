@@ -1,4 +1,4 @@
-package main
+package toxiproxy
 
 import (
 	"bytes"
@@ -313,3 +313,174 @@ func AssertProxyUp(t *testing.T, addr string, up bool) net.Conn {
 	}
 	return conn
 }
+
+// Writes msg to the connection and reads back as much, returning an error if
+// nothing is echoed within the timeout.
+func Echo(conn net.Conn, msg string, timeout time.Duration) (string, error) {
+	_, err := conn.Write([]byte(msg))
+	if err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	return string(buf), err
+}
+
+func TestProxyMaxConnectionsReject(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.MaxConnections = 1
+	proxy.Start()
+	defer proxy.Stop()
+
+	first := AssertProxyUp(t, proxy.Listen, true)
+	if reply, err := Echo(first, "one", time.Second); reply != "one" {
+		t.Fatal("Expected first client to be let in:", err)
+	}
+
+	second := AssertProxyUp(t, proxy.Listen, true)
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected client over the limit to be closed, got", err)
+	}
+	if proxy.Rejected() != 1 {
+		t.Fatal("Expected 1 rejected client, got", proxy.Rejected())
+	}
+
+	// The slot frees up asynchronously once the first client disconnects
+	first.Close()
+	for i := 0; i < 100; i++ {
+		conn := AssertProxyUp(t, proxy.Listen, true)
+		reply, _ := Echo(conn, "three", time.Second)
+		conn.Close()
+		if reply == "three" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected a client to be let in after the first one disconnected")
+}
+
+func TestProxyMaxConnectionsQueue(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.MaxConnections = 1
+	proxy.QueueConnections = true
+	proxy.Start()
+	defer proxy.Stop()
+
+	first := AssertProxyUp(t, proxy.Listen, true)
+	if reply, err := Echo(first, "one", time.Second); reply != "one" {
+		t.Fatal("Expected first client to be let in:", err)
+	}
+
+	second := AssertProxyUp(t, proxy.Listen, true)
+	defer second.Close()
+	if _, err := Echo(second, "two", 100*time.Millisecond); err == nil {
+		t.Fatal("Expected client over the limit to be queued")
+	}
+
+	first.Close()
+	buf := make([]byte, 3)
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(second, buf)
+	if err != nil || string(buf) != "two" {
+		t.Fatalf("Expected queued client to be let in, got %q %v", buf, err)
+	}
+	if proxy.Rejected() != 0 {
+		t.Fatal("Expected no rejected clients, got", proxy.Rejected())
+	}
+}
+
+func TestProxyAcceptRate(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.AcceptRate = 20
+	proxy.Start()
+	defer proxy.Stop()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		conn := AssertProxyUp(t, proxy.Listen, true)
+		if reply, err := Echo(conn, "hello", time.Second); reply != "hello" {
+			t.Fatal("Expected client to be let in:", err)
+		}
+		conn.Close()
+	}
+
+	// The first client is let in right away, then one every 50ms
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatal("Expected clients to be throttled, took", elapsed)
+	}
+}
+
+func TestProxyRaiseMaxConnections(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.MaxConnections = 1
+	proxy.QueueConnections = true
+	proxy.Start()
+	defer proxy.Stop()
+
+	first := AssertProxyUp(t, proxy.Listen, true)
+	defer first.Close()
+	Echo(first, "one", time.Second)
+	second := AssertProxyUp(t, proxy.Listen, true)
+	defer second.Close()
+
+	err := proxy.Update(&Proxy{Listen: proxy.Listen, Upstream: proxy.Upstream, Enabled: true, MaxConnections: 2})
+	if err != nil {
+		t.Fatal("Failed to update proxy", err)
+	}
+	if reply, err := Echo(second, "two", time.Second); reply != "two" {
+		t.Fatal("Expected queued client to be let in once the limit was raised:", err)
+	}
+}
+
+func TestProxyPauseAccept(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.Start()
+	defer proxy.Stop()
+
+	// Pause while the accept loop is blocked waiting for a client
+	proxy.Pause()
+	if !proxy.Paused() {
+		t.Fatal("Expected proxy to be paused")
+	}
+
+	// The kernel still completes the handshake, but the proxy doesn't read
+	conn := AssertProxyUp(t, proxy.Listen, true)
+	defer conn.Close()
+	if _, err := Echo(conn, "hello", 100*time.Millisecond); err == nil {
+		t.Fatal("Expected client to wait in the listen backlog")
+	}
+
+	proxy.Resume()
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("Expected client to be accepted once resumed, got %q %v", buf, err)
+	}
+}
+
+func TestProxyPausedAcrossRestart(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.Start()
+	defer proxy.Stop()
+
+	proxy.Pause()
+	proxy.Stop()
+	proxy.Start()
+
+	conn := AssertProxyUp(t, proxy.Listen, true)
+	defer conn.Close()
+	if _, err := Echo(conn, "hello", 100*time.Millisecond); err == nil {
+		t.Fatal("Expected proxy to stay paused after restarting")
+	}
+
+	proxy.Resume()
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal("Expected client to be accepted once resumed:", err)
+	}
+}
@@ -0,0 +1,204 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Versions of the PROXY protocol a proxy can send to the upstream, as described
+// in https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest v1 header, including the CRLF.
+const proxyProtocolV1MaxLength = 107
+
+// A proxyHeader holds the addresses of the original client of a connection,
+// and the address it connected to. They're nil when the sender didn't know
+// them, such as for health checks.
+type proxyHeader struct {
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// validateProxyProtocol checks the PROXY protocol fields of a proxy.
+func validateProxyProtocol(proxy *Proxy) error {
+	switch proxy.SendProxyProtocol {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return fmt.Errorf("Invalid send_proxy_protocol: %s", proxy.SendProxyProtocol)
+	}
+	if proxy.SendProxyProtocol != "" && proxy.CassetteMode != "" {
+		return errors.New("Invalid send_proxy_protocol: can't be used with a cassette")
+	}
+	return nil
+}
+
+// Returns the header describing the client as it connected to the proxy.
+func connectionHeader(client net.Conn) *proxyHeader {
+	source, _ := client.RemoteAddr().(*net.TCPAddr)
+	destination, _ := client.LocalAddr().(*net.TCPAddr)
+	if source == nil || destination == nil {
+		return &proxyHeader{}
+	}
+	return &proxyHeader{source, destination}
+}
+
+// Reads the v1 or v2 PROXY protocol header the client starts with. The
+// returned connection includes any data the client sent after the header.
+func readProxyHeader(client net.Conn) (*proxyHeader, net.Conn, error) {
+	reader := bufio.NewReader(client)
+	start, err := reader.Peek(len(proxyProtocolSignature))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var header *proxyHeader
+	if bytes.Equal(start, proxyProtocolSignature) {
+		header, err = readProxyHeaderV2(reader)
+	} else if bytes.HasPrefix(start, []byte("PROXY ")) {
+		header, err = readProxyHeaderV1(reader)
+	} else {
+		err = errors.New("Missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if reader.Buffered() > 0 {
+		return header, &bufferedConn{client, reader}, nil
+	}
+	return header, client, nil
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (*proxyHeader, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &proxyHeader{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY protocol v1 header: %q", line)
+	}
+
+	source, sourceErr := parseProxyAddr(fields[2], fields[4])
+	destination, destinationErr := parseProxyAddr(fields[3], fields[5])
+	if sourceErr != nil || destinationErr != nil {
+		return nil, fmt.Errorf("Invalid PROXY protocol v1 header: %q", line)
+	}
+	return &proxyHeader{source, destination}, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("invalid address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(portNumber)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (*proxyHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version: %d", fixed[12]>>4)
+	}
+	// The addresses may be followed by TLVs, which are skipped
+	data := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	header := &proxyHeader{}
+	if fixed[12]&0x0f == 0 { // LOCAL, sent by the proxy itself
+		return header, nil
+	}
+	switch fixed[13] {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, errors.New("Invalid PROXY protocol v2 header: address too short")
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(data[4:8]), Port: int(binary.BigEndian.Uint16(data[10:]))}
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, errors.New("Invalid PROXY protocol v2 header: address too short")
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(data[16:32]), Port: int(binary.BigEndian.Uint16(data[34:]))}
+	}
+	// Other families, such as UDP or unix sockets, are treated as unknown
+	return header, nil
+}
+
+// Encodes the header in the given version of the PROXY protocol.
+func (header *proxyHeader) encode(version string) []byte {
+	known := header.Source != nil && header.Destination != nil
+	source, destination := header.Source, header.Destination
+	ipv4 := known && source.IP.To4() != nil && destination.IP.To4() != nil
+
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		if ipv4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", source.IP.To4(), destination.IP.To4(), source.Port, destination.Port))
+		}
+		// An IPv4 address mixed with an IPv6 one is sent IPv4-mapped, as in v2
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(source.IP), ipv6String(destination.IP), source.Port, destination.Port))
+	}
+
+	encoded := append([]byte(nil), proxyProtocolSignature...)
+	if !known {
+		return append(encoded, 0x20, 0, 0, 0)
+	}
+	var addrs []byte
+	if ipv4 {
+		encoded = append(encoded, 0x21, 0x11)
+		addrs = append(append(addrs, source.IP.To4()...), destination.IP.To4()...)
+	} else {
+		encoded = append(encoded, 0x21, 0x21)
+		addrs = append(append(addrs, source.IP.To16()...), destination.IP.To16()...)
+	}
+	addrs = append(addrs, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(addrs[len(addrs)-4:], uint16(source.Port))
+	binary.BigEndian.PutUint16(addrs[len(addrs)-2:], uint16(destination.Port))
+
+	encoded = append(encoded, 0, 0)
+	binary.BigEndian.PutUint16(encoded[len(encoded)-2:], uint16(len(addrs)))
+	return append(encoded, addrs...)
+}
+
+// Formats the IP as an IPv6 address, such as ::ffff:192.0.2.10 for an IPv4 one.
+// net.IP prints IPv4-mapped addresses in IPv4 form.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,184 @@
+package toxiproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// Reads the header from data sent by another goroutine, returning it with the
+// data that followed it.
+func ReadTestProxyHeader(data []byte) (*proxyHeader, string, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	defer server.Close()
+
+	header, conn, err := readProxyHeader(server)
+	if err != nil {
+		return nil, "", err
+	}
+	rest, _ := ioutil.ReadAll(conn)
+	return header, string(rest), nil
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	headers := []*proxyHeader{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.20"), Port: 80}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 5000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::20"), Port: 443}},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::20"), Port: 443}},
+		{},
+	}
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, expected := range headers {
+			header, rest, err := ReadTestProxyHeader(append(expected.encode(version), "hello"...))
+			if err != nil {
+				t.Fatalf("Failed to read %s header %+v: %v", version, expected, err)
+			}
+			if fmt.Sprint(header.Source, header.Destination) != fmt.Sprint(expected.Source, expected.Destination) {
+				t.Errorf("Expected %s header %+v, got %+v", version, expected, header)
+			}
+			if rest != "hello" {
+				t.Errorf("Expected data after the %s header, got %q", version, rest)
+			}
+		}
+	}
+
+	// Both addresses of a TCP6 header have to be IPv6
+	if encoded := string(headers[2].encode(ProxyProtocolV1)); encoded != "PROXY TCP6 ::ffff:192.0.2.10 2001:db8::20 5000 443\r\n" {
+		t.Errorf("Expected mixed addresses to be sent as IPv6, got %q", encoded)
+	}
+}
+
+func TestProxyHeaderV1(t *testing.T) {
+	header, _, err := ReadTestProxyHeader([]byte("PROXY TCP4 192.0.2.10 192.0.2.20 5000 80\r\n"))
+	if err != nil {
+		t.Fatal("Failed to read header", err)
+	}
+	if header.Source.String() != "192.0.2.10:5000" || header.Destination.String() != "192.0.2.20:80" {
+		t.Fatalf("Unexpected header %+v", header)
+	}
+
+	invalid := []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 192.0.2.10 192.0.2.20 5000\r\n",
+		"PROXY TCP4 192.0.2.10 192.0.2.20 5000 70000\r\n",
+		"PROXY TCP4 192.0.2.10 192.0.2.20 5000 80" + string(make([]byte, 100)),
+	}
+	for _, data := range invalid {
+		if _, _, err := ReadTestProxyHeader([]byte(data)); err == nil {
+			t.Errorf("Expected error reading header %q", data)
+		}
+	}
+}
+
+func TestProxyAcceptProxyProtocol(t *testing.T) {
+	WithTCPServer(t, func(upstream string, response chan []byte) {
+		proxy := NewTestProxy("test", upstream)
+		proxy.AcceptProxyProtocol = true
+		proxy.SendProxyProtocol = ProxyProtocolV2
+		proxy.Start()
+		defer proxy.Stop()
+
+		conn := AssertProxyUp(t, proxy.Listen, true)
+		conn.Write([]byte("PROXY TCP4 192.0.2.10 192.0.2.20 5000 80\r\nhello"))
+		conn.Close()
+
+		header, rest, err := ReadTestProxyHeader(<-response)
+		if err != nil {
+			t.Fatal("Expected upstream to receive a header", err)
+		}
+		if header.Source.String() != "192.0.2.10:5000" || header.Destination.String() != "192.0.2.20:80" {
+			t.Fatalf("Expected upstream to receive the client's header, got %+v", header)
+		}
+		if rest != "hello" {
+			t.Fatalf("Expected upstream to receive hello, got %q", rest)
+		}
+	})
+}
+
+func TestProxySendProxyProtocol(t *testing.T) {
+	WithTCPServer(t, func(upstream string, response chan []byte) {
+		proxy := NewTestProxy("test", upstream)
+		proxy.SendProxyProtocol = ProxyProtocolV1
+		proxy.Start()
+		defer proxy.Stop()
+
+		conn := AssertProxyUp(t, proxy.Listen, true)
+		conn.Write([]byte("hello"))
+		conn.Close()
+
+		expected := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\nhello",
+			conn.LocalAddr().(*net.TCPAddr).Port, conn.RemoteAddr().(*net.TCPAddr).Port)
+		if resp := <-response; string(resp) != expected {
+			t.Fatalf("Expected upstream to receive %q, got %q", expected, resp)
+		}
+	})
+}
+
+func TestProxyProtocolHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	proxy := NewTestProxy("test", ln.Addr().String())
+	proxy.AcceptProxyProtocol = true
+	proxy.Start()
+	defer proxy.Stop()
+	proxy.AddToxic("downstream", &HalfOpenToxic{Mode: HalfOpenCloseWrite})
+
+	client := AssertProxyUp(t, proxy.Listen, true)
+	defer client.Close()
+	// Data sent with the header is buffered, so the proxy wraps the client
+	client.Write([]byte("PROXY TCP4 192.0.2.10 192.0.2.20 5000 80\r\nearly"))
+	upstream, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unable to accept TCP connection", err)
+	}
+	defer upstream.Close()
+	early := make([]byte, 5)
+	upstream.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(upstream, early); err != nil || string(early) != "early" {
+		t.Fatalf("Expected upstream to receive early, got %q: %v", early, err)
+	}
+
+	// The client gets a FIN through the connection wrapping it, but can still write
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected client to receive a FIN, got", err)
+	}
+	AssertWritesThrough(t, client, upstream, "hello")
+}
+
+func TestProxyRejectsMissingProxyHeader(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.AcceptProxyProtocol = true
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn := AssertProxyUp(t, proxy.Listen, true)
+	conn.Write([]byte("hello, no header here"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected proxy to close client without a PROXY protocol header, got", err)
+	}
+}
+
+func TestValidateProxyProtocol(t *testing.T) {
+	if err := validateProxyProtocol(&Proxy{SendProxyProtocol: ProxyProtocolV2}); err != nil {
+		t.Fatal("Expected v2 to be valid", err)
+	}
+	if err := validateProxyProtocol(&Proxy{SendProxyProtocol: "v3"}); err == nil {
+		t.Fatal("Expected error for unknown version")
+	}
+	if err := validateProxyProtocol(&Proxy{SendProxyProtocol: ProxyProtocolV1, CassetteMode: CassetteModeRecord}); err == nil {
+		t.Fatal("Expected error sending a header with a cassette")
+	}
+}
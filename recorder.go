@@ -0,0 +1,388 @@
+package toxiproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The Recorder writes the traffic going through a proxy to a pcap-ng file so
+// it can be inspected with tools such as Wireshark. Each link is tapped twice:
+// once when data enters the toxic chain, and once when it leaves it. Since no
+// real packets exist at that point, synthetic IP and TCP headers are generated
+// for every chunk of data.
+//
+//             before                       after
+//               v                            v
+// Client > ChanWriter > ToxicStubs > ChanReader > Upstream
+//
+// The taps use the addresses of the underlying sockets, so a capture shows two
+// TCP conversations per connection: client <-> proxy and proxy <-> upstream.
+type Recorder struct {
+	sync.Mutex
+
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path"`
+
+	file          *os.File
+	conversations map[string]*recorderConversation
+}
+
+// Tracks the synthetic TCP sequence numbers of a conversation between 2 addresses.
+type recorderConversation struct {
+	seq map[string]uint32
+	// The number of directions that sent a FIN, the conversation is forgotten
+	// once both did
+	fins int
+}
+
+// A recorderTap records one direction of a conversation.
+type recorderTap struct {
+	recorder *Recorder
+	src      *net.TCPAddr
+	dst      *net.TCPAddr
+	comment  string
+}
+
+var ErrRecorderMissingPath = errors.New("Missing required field: path")
+
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngOptionEnd       = 0
+	pcapngOptionComment   = 1
+	pcapngOptionInterface = 2
+	pcapngLinkTypeRaw     = 101
+
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+
+	// Large chunks are split so the synthetic packets fit in an IP datagram
+	recorderMaxSegment = 32 * 1024
+)
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Update starts or stops the recording. Changing the path of a running
+// recording starts a new capture file.
+func (r *Recorder) Update(enabled bool, path string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if enabled && len(path) < 1 {
+		return ErrRecorderMissingPath
+	}
+
+	if r.Enabled && (!enabled || path != r.Path) {
+		r.stop()
+	}
+	r.Path = path
+	if enabled && !r.Enabled {
+		return r.start()
+	}
+	return nil
+}
+
+// Stop closes the capture file if the recorder is running.
+func (r *Recorder) Stop() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.stop()
+}
+
+// Returns true if traffic is being recorded.
+func (r *Recorder) recording() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.Enabled
+}
+
+// Tap returns a tap for data sent from the source to the destination address.
+// Returns nil if either address isn't a TCP address.
+func (r *Recorder) Tap(src, dst net.Addr, comment string) *recorderTap {
+	srcTCP, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	dstTCP, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return &recorderTap{r, srcTCP, dstTCP, comment}
+}
+
+// Starts the recording, assumes the lock has already been taken
+func (r *Recorder) start() error {
+	file, err := os.Create(r.Path)
+	if err != nil {
+		return err
+	}
+
+	r.file = file
+	r.conversations = make(map[string]*recorderConversation)
+	r.Enabled = true
+
+	err = r.writeHeader()
+	if err != nil {
+		r.stop()
+		return err
+	}
+	return nil
+}
+
+// Stops the recording, assumes the lock has already been taken
+func (r *Recorder) stop() {
+	if !r.Enabled {
+		return
+	}
+	r.Enabled = false
+	r.file.Close()
+	r.file = nil
+	r.conversations = nil
+}
+
+func (r *Recorder) writeHeader() error {
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+	binary.Write(body, binary.LittleEndian, uint16(1)) // Major version
+	binary.Write(body, binary.LittleEndian, uint16(0)) // Minor version
+	binary.Write(body, binary.LittleEndian, int64(-1)) // Unspecified section length
+	err := r.writeBlock(pcapngSectionHeader, body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	body.Reset()
+	binary.Write(body, binary.LittleEndian, uint16(pcapngLinkTypeRaw))
+	binary.Write(body, binary.LittleEndian, uint16(0)) // Reserved
+	binary.Write(body, binary.LittleEndian, uint32(0)) // No snap length
+	writePcapngOption(body, pcapngOptionInterface, []byte("toxiproxy"))
+	writePcapngOption(body, pcapngOptionEnd, nil)
+	return r.writeBlock(pcapngInterface, body.Bytes())
+}
+
+func (r *Recorder) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(len(body) + 12)
+	block := new(bytes.Buffer)
+	binary.Write(block, binary.LittleEndian, blockType)
+	binary.Write(block, binary.LittleEndian, length)
+	block.Write(body)
+	binary.Write(block, binary.LittleEndian, length)
+	_, err := r.file.Write(block.Bytes())
+	return err
+}
+
+func (r *Recorder) writePacket(timestamp time.Time, packet []byte, comment string) error {
+	micros := uint64(timestamp.UnixNano() / int64(time.Microsecond))
+
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.LittleEndian, uint32(0)) // Interface id
+	binary.Write(body, binary.LittleEndian, uint32(micros>>32))
+	binary.Write(body, binary.LittleEndian, uint32(micros))
+	binary.Write(body, binary.LittleEndian, uint32(len(packet)))
+	binary.Write(body, binary.LittleEndian, uint32(len(packet)))
+	body.Write(packet)
+	body.Write(make([]byte, pcapngPadding(len(packet))))
+	if len(comment) > 0 {
+		writePcapngOption(body, pcapngOptionComment, []byte(comment))
+		writePcapngOption(body, pcapngOptionEnd, nil)
+	}
+	return r.writeBlock(pcapngEnhancedPacket, body.Bytes())
+}
+
+// Writes a segment with synthetic headers, and advances the sequence number of
+// the sender. The first segment of a conversation is preceded by a handshake.
+// Assumes the lock has already been taken.
+func (r *Recorder) writeSegment(t *recorderTap, timestamp time.Time, flags byte, data []byte) error {
+	key, reverse := t.src.String()+" "+t.dst.String(), t.dst.String()+" "+t.src.String()
+	conv, ok := r.conversations[key]
+	if !ok {
+		if conv, ok = r.conversations[reverse]; ok {
+			key = reverse
+		}
+	}
+	if !ok {
+		conv = &recorderConversation{seq: make(map[string]uint32)}
+		r.conversations[key] = conv
+
+		reply := &recorderTap{r, t.dst, t.src, ""}
+		segments := []struct {
+			tap   *recorderTap
+			flags byte
+		}{
+			{t, tcpFlagSyn},
+			{reply, tcpFlagSyn | tcpFlagAck},
+			{t, tcpFlagAck},
+		}
+		for _, segment := range segments {
+			err := r.writePacket(timestamp, conv.packet(segment.tap, segment.flags, nil), "")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if flags&tcpFlagFin != 0 {
+		conv.fins++
+		if conv.fins == 2 {
+			delete(r.conversations, key)
+		}
+	}
+	return r.writePacket(timestamp, conv.packet(t, flags, data), t.comment)
+}
+
+// Builds a packet for the tap's direction and advances its sequence number.
+func (c *recorderConversation) packet(t *recorderTap, flags byte, data []byte) []byte {
+	seq := c.seq[t.src.String()]
+	ack := c.seq[t.dst.String()]
+	if flags&tcpFlagAck == 0 {
+		ack = 0
+	}
+
+	advance := uint32(len(data))
+	if flags&(tcpFlagSyn|tcpFlagFin) != 0 {
+		advance++
+	}
+	c.seq[t.src.String()] = seq + advance
+
+	return buildPacket(t.src, t.dst, seq, ack, flags, data)
+}
+
+// Record data flowing through the tap. Does nothing if the recorder is stopped.
+func (t *recorderTap) Write(data []byte) {
+	t.record(tcpFlagPsh|tcpFlagAck, data)
+}
+
+// Record the end of the stream flowing through the tap.
+func (t *recorderTap) Close() {
+	t.record(tcpFlagFin|tcpFlagAck, nil)
+}
+
+func (t *recorderTap) record(flags byte, data []byte) {
+	if t == nil {
+		return
+	}
+
+	r := t.recorder
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.Enabled {
+		return
+	}
+
+	now := time.Now()
+	for {
+		segment := data
+		if len(segment) > recorderMaxSegment {
+			segment = segment[:recorderMaxSegment]
+		}
+		data = data[len(segment):]
+
+		err := r.writeSegment(t, now, flags, segment)
+		if err != nil {
+			// Stop recording rather than writing a corrupt capture
+			r.stop()
+			return
+		}
+		if len(data) == 0 {
+			return
+		}
+	}
+}
+
+func writePcapngOption(buf *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(buf, binary.LittleEndian, code)
+	binary.Write(buf, binary.LittleEndian, uint16(len(value)))
+	buf.Write(value)
+	buf.Write(make([]byte, pcapngPadding(len(value))))
+}
+
+// Returns the number of bytes needed to pad to a 32 bit boundary
+func pcapngPadding(length int) int {
+	return (4 - length%4) % 4
+}
+
+// Builds an IPv4 or IPv6 packet containing a TCP segment.
+func buildPacket(src, dst *net.TCPAddr, seq, ack uint32, flags byte, data []byte) []byte {
+	tcp := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // Header length in 32 bit words
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // Window size
+	tcp = append(tcp, data...)
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP != nil && dstIP != nil {
+		pseudo := make([]byte, 0, 12)
+		pseudo = append(pseudo, srcIP...)
+		pseudo = append(pseudo, dstIP...)
+		pseudo = append(pseudo, 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45 // Version 4, header length of 5 words
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(tcp)))
+		ip[6] = 0x40 // Don't fragment
+		ip[8] = 64   // TTL
+		ip[9] = 6    // TCP
+		copy(ip[12:], srcIP)
+		copy(ip[16:], dstIP)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		return append(ip, tcp...)
+	}
+
+	srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	if srcIP == nil {
+		srcIP = net.IPv6loopback
+	}
+	if dstIP == nil {
+		dstIP = net.IPv6loopback
+	}
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, srcIP...)
+	pseudo = append(pseudo, dstIP...)
+	pseudo = append(pseudo, byte(len(tcp)>>24), byte(len(tcp)>>16), byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 0x60 // Version 6
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6  // TCP
+	ip[7] = 64 // Hop limit
+	copy(ip[8:], srcIP)
+	copy(ip[24:], dstIP)
+	return append(ip, tcp...)
+}
+
+// Computes the internet checksum of the concatenated buffers. All buffers
+// except the last must have an even length.
+func checksum(bufs ...[]byte) uint16 {
+	var sum uint32
+	for _, buf := range bufs {
+		for i := 0; i+1 < len(buf); i += 2 {
+			sum += uint32(buf[i])<<8 | uint32(buf[i+1])
+		}
+		if len(buf)%2 == 1 {
+			sum += uint32(buf[len(buf)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,156 @@
+package toxiproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func ReadPcapngBlocks(t *testing.T, path string) []pcapngBlock {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("Failed to read capture file", err)
+	}
+
+	var blocks []pcapngBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("Truncated block in capture: %d bytes left", len(data))
+		}
+		blockType := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) {
+			t.Fatalf("Invalid block length in capture: %d", length)
+		}
+		if binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatal("Trailing block length did not match")
+		}
+		blocks = append(blocks, pcapngBlock{blockType, data[8 : length-4]})
+		data = data[length:]
+	}
+	return blocks
+}
+
+// Returns the TCP payloads of all the packets in the capture
+func ReadPcapngPayloads(t *testing.T, path string) [][]byte {
+	blocks := ReadPcapngBlocks(t, path)
+	if len(blocks) < 2 || blocks[0].blockType != pcapngSectionHeader || blocks[1].blockType != pcapngInterface {
+		t.Fatal("Capture did not start with a section header and interface description")
+	}
+
+	var payloads [][]byte
+	for _, block := range blocks[2:] {
+		if block.blockType != pcapngEnhancedPacket {
+			t.Fatalf("Unexpected block type in capture: %x", block.blockType)
+		}
+		length := binary.LittleEndian.Uint32(block.body[12:])
+		packet := block.body[20 : 20+length]
+		if packet[0]>>4 != 4 || checksum(packet[:20]) != 0 {
+			t.Fatal("Capture contained an invalid IPv4 header")
+		}
+		tcp := packet[20:]
+		if checksum(append(append(append([]byte{}, packet[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp))), tcp...)) != 0 {
+			t.Fatal("Capture contained an invalid TCP checksum")
+		}
+		if len(tcp) > 20 {
+			payloads = append(payloads, tcp[20:])
+		}
+	}
+	return payloads
+}
+
+func TestRecorderRequiresPath(t *testing.T) {
+	recorder := NewRecorder()
+	err := recorder.Update(true, "")
+	if err != ErrRecorderMissingPath {
+		t.Fatal("Expected recorder to require a path", err)
+	}
+	if recorder.Enabled {
+		t.Fatal("Expected recorder to stay disabled")
+	}
+}
+
+func TestRecordProxyTraffic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "toxiproxy")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.pcapng")
+
+	WithEchoProxy(t, func(conn net.Conn, response chan []byte, proxy *Proxy) {
+		err := proxy.updateRecorder(true, path)
+		if err != nil {
+			t.Fatal("Failed to start recording", err)
+		}
+		proxy.upToxics.SetToxicValue(&LatencyToxic{Enabled: true, Latency: 10})
+
+		msg := []byte("hello world\n")
+		_, err = conn.Write(msg)
+		if err != nil {
+			t.Error("Failed writing to TCP server", err)
+		}
+		<-response
+
+		buf := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(buf)
+		if err != nil {
+			t.Error("Failed reading from TCP server", err)
+		}
+
+		proxy.recorder.Stop()
+
+		// The message was recorded both before and after the toxics, in both directions
+		payloads := ReadPcapngPayloads(t, path)
+		if len(payloads) != 4 {
+			t.Fatalf("Expected 4 packets with data, got %d", len(payloads))
+		}
+		for _, payload := range payloads {
+			if !bytes.Equal(payload, msg) {
+				t.Errorf("Capture contained unexpected data: %q", payload)
+			}
+		}
+	})
+}
+
+func TestRecorderForgetsClosedConversations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "toxiproxy")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	recorder := NewRecorder()
+	err = recorder.Update(true, filepath.Join(dir, "capture.pcapng"))
+	if err != nil {
+		t.Fatal("Failed to start recording", err)
+	}
+	defer recorder.Stop()
+
+	client := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	proxy := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8474}
+	up := recorder.Tap(client, proxy, "")
+	down := recorder.Tap(proxy, client, "")
+	up.Write([]byte("hello"))
+	down.Write([]byte("world"))
+
+	up.Close()
+	if len(recorder.conversations) != 1 {
+		t.Fatal("Expected half closed conversation to be kept")
+	}
+	down.Close()
+	if len(recorder.conversations) != 0 {
+		t.Fatal("Expected closed conversation to be forgotten, got", len(recorder.conversations))
+	}
+}
@@ -0,0 +1,263 @@
+package toxiproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const srvScheme = "srv://"
+
+// A Resolver looks up the addresses of upstreams before they're dialed. An
+// upstream such as srv://_mysql._tcp.service is looked up with an SRV query,
+// and its targets are tried in order of priority, picked by weight for each
+// connection.
+type Resolver struct {
+	// The DNS server to query, as host:port. The system resolver is used if empty
+	Address string
+	// How long addresses are cached for. If 0 they're looked up for every
+	// connection. Go's resolver doesn't return the TTL of records, so it's the
+	// same for every upstream.
+	TTL time.Duration
+
+	sync.Mutex
+	cache map[string]resolverEntry
+	// When expired entries were last removed from the cache
+	swept time.Time
+}
+
+type resolverEntry struct {
+	result  interface{} // []string of addresses, or []*net.SRV
+	expires time.Time
+}
+
+// DefaultResolver is used by proxies to resolve their upstreams, looking up
+// addresses with the system resolver for every connection.
+var DefaultResolver = NewResolver("", 0)
+
+func NewResolver(address string, ttl time.Duration) *Resolver {
+	return &Resolver{
+		Address: address,
+		TTL:     ttl,
+		cache:   make(map[string]resolverEntry),
+	}
+}
+
+// A ResolveError is returned for an upstream that couldn't be looked up, as
+// opposed to one that couldn't be connected to.
+type ResolveError struct {
+	Upstream string
+	Err      error
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("Unable to resolve %s: %v", e.Upstream, e.Err)
+}
+
+// Returned in a *ResolveError when a lookup succeeds without any addresses,
+// which toxics acting on lookups can do.
+var errNoAddresses = errors.New("No addresses found")
+
+func IsSRVUpstream(upstream string) bool {
+	return strings.HasPrefix(upstream, srvScheme)
+}
+
+// Dial connects to the first address of the upstream accepting the connection.
+// Errors looking up the upstream are returned as a *ResolveError.
+func (r *Resolver) Dial(upstream string) (net.Conn, error) {
+	addrs, err := r.resolve(context.Background(), upstream)
+	if err == nil && len(addrs) == 0 {
+		err = errNoAddresses
+	}
+	if err != nil {
+		return nil, &ResolveError{upstream, err}
+	}
+	return dialAddrs(context.Background(), addrs)
+}
+
+// Connects to the first of the addresses accepting the connection.
+func dialAddrs(ctx context.Context, addrs []string) (net.Conn, error) {
+	var dialer net.Dialer
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Resolve returns the addresses of the upstream as ip:port, in the order they
+// should be tried.
+func (r *Resolver) Resolve(upstream string) ([]string, error) {
+	return r.resolve(context.Background(), upstream)
+}
+
+func (r *Resolver) resolve(ctx context.Context, upstream string) ([]string, error) {
+	if IsSRVUpstream(upstream) {
+		return r.resolveSRV(ctx, strings.TrimPrefix(upstream, srvScheme))
+	}
+
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+func (r *Resolver) resolveSRV(ctx context.Context, name string) ([]string, error) {
+	result, err := r.cached("srv:"+name, func(resolver *net.Resolver) (interface{}, error) {
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+		return srvs, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, srv := range orderSRV(result.([]*net.SRV)) {
+		ips, lookupErr := r.lookupHost(ctx, strings.TrimSuffix(srv.Target, "."))
+		if lookupErr != nil {
+			err = lookupErr
+			continue // Try the next target
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(int(srv.Port))))
+		}
+	}
+	if len(addrs) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no targets for %s", name)
+		}
+		return nil, err
+	}
+	return addrs, nil
+}
+
+func (r *Resolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	result, err := r.cached("host:"+host, func(resolver *net.Resolver) (interface{}, error) {
+		return resolver.LookupHost(ctx, host)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]string), nil
+}
+
+// Returns the result of lookup for the key, calling it if it's not cached.
+// Failed lookups aren't cached.
+func (r *Resolver) cached(key string, lookup func(*net.Resolver) (interface{}, error)) (interface{}, error) {
+	r.Lock()
+	entry, ok := r.cache[key]
+	if ok && !time.Now().Before(entry.expires) {
+		delete(r.cache, key)
+		ok = false
+	}
+	ttl := r.TTL
+	resolver := r.resolver()
+	r.Unlock()
+	if ok {
+		return entry.result, nil
+	}
+
+	result, err := lookup(resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		r.Lock()
+		now := time.Now()
+		r.evict(now, ttl)
+		r.cache[key] = resolverEntry{result, now.Add(ttl)}
+		r.Unlock()
+	}
+	return result, nil
+}
+
+// Removes expired entries, at most once per ttl, so upstreams that are no
+// longer used don't stay cached. Assumes the lock has already been taken.
+func (r *Resolver) evict(now time.Time, ttl time.Duration) {
+	if now.Sub(r.swept) < ttl {
+		return
+	}
+	for key, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, key)
+		}
+	}
+	r.swept = now
+}
+
+// Returns the resolver querying Address, or the system resolver.
+func (r *Resolver) resolver() *net.Resolver {
+	if r.Address == "" {
+		return net.DefaultResolver
+	}
+
+	address := r.Address
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// Orders SRV records as described in RFC 2782: by priority, then picking
+// randomly in proportion to their weight among records of the same priority.
+func orderSRV(srvs []*net.SRV) []*net.SRV {
+	remaining := append([]*net.SRV(nil), srvs...)
+	ordered := make([]*net.SRV, 0, len(srvs))
+	for len(remaining) > 0 {
+		// Records of the lowest remaining priority
+		priority := remaining[0].Priority
+		for _, srv := range remaining {
+			if srv.Priority < priority {
+				priority = srv.Priority
+			}
+		}
+
+		total := 0
+		for _, srv := range remaining {
+			if srv.Priority == priority {
+				total += int(srv.Weight) + 1 // Give records of weight 0 a small chance
+			}
+		}
+		pick := rand.Intn(total)
+		for i, srv := range remaining {
+			if srv.Priority != priority {
+				continue
+			}
+			pick -= int(srv.Weight) + 1
+			if pick < 0 {
+				ordered = append(ordered, srv)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
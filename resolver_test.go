@@ -0,0 +1,359 @@
+package toxiproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A TestDNSServer answers A and SRV queries over UDP from its records, and
+// NXDOMAIN for any other name.
+type TestDNSServer struct {
+	Addr string
+
+	sync.Mutex
+	conn     net.PacketConn
+	hosts    map[string][]net.IP
+	services map[string][]net.SRV
+	queries  map[string]int
+}
+
+func NewTestDNSServer(t *testing.T) *TestDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create DNS server", err)
+	}
+
+	server := &TestDNSServer{
+		Addr:     conn.LocalAddr().String(),
+		conn:     conn,
+		hosts:    make(map[string][]net.IP),
+		services: make(map[string][]net.SRV),
+		queries:  make(map[string]int),
+	}
+	go server.serve()
+	return server
+}
+
+// Sets the A records of the name, such as db.toxiproxy.test.
+func (s *TestDNSServer) SetHost(name string, ips ...string) {
+	s.Lock()
+	defer s.Unlock()
+	s.hosts[name+"."] = nil
+	for _, ip := range ips {
+		s.hosts[name+"."] = append(s.hosts[name+"."], net.ParseIP(ip).To4())
+	}
+}
+
+// Sets the SRV records of the name, such as _db._tcp.toxiproxy.test.
+func (s *TestDNSServer) SetService(name string, srvs ...net.SRV) {
+	s.Lock()
+	defer s.Unlock()
+	s.services[name+"."] = srvs
+}
+
+// Returns the number of queries of any type received for the name.
+func (s *TestDNSServer) Queries(name string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries[name+"."]
+}
+
+func (s *TestDNSServer) Close() {
+	s.conn.Close()
+}
+
+func (s *TestDNSServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if response := s.answer(buf[:n]); response != nil {
+			s.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *TestDNSServer) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// Read the name of the question, as labels prefixed by their length
+	var labels []string
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		size := int(query[end])
+		if end+1+size > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[end+1:end+1+size]))
+		end += 1 + size
+	}
+	end += 5 // The terminating label, type and class
+	if end > len(query) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	s.Lock()
+	defer s.Unlock()
+	s.queries[name]++
+
+	var answers [][]byte
+	var rcode byte
+	hosts, hostOk := s.hosts[name]
+	services, serviceOk := s.services[name]
+	switch {
+	case qtype == 1 && hostOk: // A
+		for _, ip := range hosts {
+			answers = append(answers, dnsRecord(1, ip))
+		}
+	case qtype == 33 && serviceOk: // SRV
+		for _, srv := range services {
+			data := make([]byte, 6)
+			binary.BigEndian.PutUint16(data, srv.Priority)
+			binary.BigEndian.PutUint16(data[2:], srv.Weight)
+			binary.BigEndian.PutUint16(data[4:], srv.Port)
+			for _, label := range strings.Split(strings.TrimSuffix(srv.Target, "."), ".") {
+				data = append(data, byte(len(label)))
+				data = append(data, label...)
+			}
+			answers = append(answers, dnsRecord(33, append(data, 0)))
+		}
+	case !hostOk && !serviceOk:
+		rcode = 3 // NXDOMAIN
+	}
+
+	response := append([]byte(nil), query[:12]...)
+	response[2] = 0x84 | query[2]&0x01 // Authoritative answer, recursion desired if asked
+	response[3] = 0x80 | rcode         // Recursion available
+	binary.BigEndian.PutUint16(response[4:], 1)
+	binary.BigEndian.PutUint16(response[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint32(response[8:], 0)
+	response = append(response, query[12:end]...)
+	for _, answer := range answers {
+		response = append(response, answer...)
+	}
+	return response
+}
+
+// Encodes a record for the name of the question, of the given type and data.
+func dnsRecord(rtype uint16, data []byte) []byte {
+	record := []byte{0xc0, 12, 0, 0, 0, 1, 0, 0, 0, 60, 0, 0}
+	binary.BigEndian.PutUint16(record[2:], rtype)
+	binary.BigEndian.PutUint16(record[10:], uint16(len(data)))
+	return append(record, data...)
+}
+
+func TestResolverCachesAddresses(t *testing.T) {
+	dns := NewTestDNSServer(t)
+	defer dns.Close()
+	dns.SetHost("db.toxiproxy.test", "127.0.0.2")
+
+	resolver := NewResolver(dns.Addr, time.Minute)
+	for i := 0; i < 3; i++ {
+		addrs, err := resolver.Resolve("db.toxiproxy.test:3306")
+		if err != nil {
+			t.Fatal("Failed to resolve upstream:", err)
+		}
+		if len(addrs) != 1 || addrs[0] != "127.0.0.2:3306" {
+			t.Fatal("Expected upstream to resolve to 127.0.0.2:3306, got", addrs)
+		}
+	}
+	queries := dns.Queries("db.toxiproxy.test")
+	if queries == 0 || queries > 2 {
+		t.Fatal("Expected the upstream to be looked up once, got queries:", queries)
+	}
+
+	// Changes to the records are seen once the cache expires
+	dns.SetHost("db.toxiproxy.test", "127.0.0.3")
+	resolver.Lock()
+	for key, entry := range resolver.cache {
+		entry.expires = time.Now()
+		resolver.cache[key] = entry
+	}
+	resolver.Unlock()
+	addrs, err := resolver.Resolve("db.toxiproxy.test:3306")
+	if err != nil || addrs[0] != "127.0.0.3:3306" {
+		t.Fatal("Expected upstream to be resolved again, got", addrs, err)
+	}
+}
+
+func TestResolverEvictsExpiredAddresses(t *testing.T) {
+	dns := NewTestDNSServer(t)
+	defer dns.Close()
+	for _, name := range []string{"a", "b", "c"} {
+		dns.SetHost(name+".toxiproxy.test", "127.0.0.2")
+	}
+
+	resolver := NewResolver(dns.Addr, 50*time.Millisecond)
+	resolver.Resolve("a.toxiproxy.test:3306")
+	resolver.Resolve("b.toxiproxy.test:3306")
+	time.Sleep(60 * time.Millisecond)
+	resolver.Resolve("c.toxiproxy.test:3306")
+
+	resolver.Lock()
+	defer resolver.Unlock()
+	if _, ok := resolver.cache["host:c.toxiproxy.test"]; len(resolver.cache) != 1 || !ok {
+		t.Fatal("Expected only the last upstream to stay cached, got", resolver.cache)
+	}
+}
+
+func TestResolverWithoutTTL(t *testing.T) {
+	dns := NewTestDNSServer(t)
+	defer dns.Close()
+	dns.SetHost("db.toxiproxy.test", "127.0.0.2")
+
+	resolver := NewResolver(dns.Addr, 0)
+	resolver.Resolve("db.toxiproxy.test:3306")
+	queries := dns.Queries("db.toxiproxy.test")
+	resolver.Resolve("db.toxiproxy.test:3306")
+	if dns.Queries("db.toxiproxy.test") <= queries {
+		t.Fatal("Expected the upstream to be looked up for every connection")
+	}
+}
+
+func TestResolverSRV(t *testing.T) {
+	dns := NewTestDNSServer(t)
+	defer dns.Close()
+	dns.SetHost("primary.toxiproxy.test", "127.0.0.2")
+	dns.SetHost("replica.toxiproxy.test", "127.0.0.3")
+	dns.SetService("_db._tcp.toxiproxy.test",
+		net.SRV{Target: "replica.toxiproxy.test", Port: 3307, Priority: 20},
+		net.SRV{Target: "primary.toxiproxy.test", Port: 3306, Priority: 10},
+	)
+
+	resolver := NewResolver(dns.Addr, 0)
+	addrs, err := resolver.Resolve("srv://_db._tcp.toxiproxy.test")
+	if err != nil {
+		t.Fatal("Failed to resolve upstream:", err)
+	}
+	if len(addrs) != 2 || addrs[0] != "127.0.0.2:3306" || addrs[1] != "127.0.0.3:3307" {
+		t.Fatal("Expected targets in order of priority, got", addrs)
+	}
+
+	_, err = resolver.Resolve("srv://_missing._tcp.toxiproxy.test")
+	if err == nil {
+		t.Fatal("Expected error resolving missing service")
+	}
+}
+
+func TestOrderSRVByWeight(t *testing.T) {
+	srvs := []*net.SRV{
+		{Target: "light", Priority: 10, Weight: 10},
+		{Target: "heavy", Priority: 10, Weight: 90},
+		{Target: "backup", Priority: 20, Weight: 100},
+	}
+
+	heavy := 0
+	for i := 0; i < 1000; i++ {
+		ordered := orderSRV(srvs)
+		if len(ordered) != 3 || ordered[2].Target != "backup" {
+			t.Fatal("Expected backup target to be last")
+		}
+		if ordered[0].Target == "heavy" {
+			heavy++
+		}
+	}
+	if heavy < 800 || heavy > 960 {
+		t.Fatal("Expected heavy target first about 90% of the time, got", heavy)
+	}
+}
+
+func TestProxyCountsResolveErrors(t *testing.T) {
+	dns := NewTestDNSServer(t)
+	defer dns.Close()
+	dns.SetHost("down.toxiproxy.test", "127.0.0.1")
+
+	proxy := NewTestProxy("test", "missing.toxiproxy.test:3306")
+	proxy.resolver = NewResolver(dns.Addr, 0)
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn := AssertProxyUp(t, proxy.Listen, true)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected proxy to close client when upstream can't be resolved, got", err)
+	}
+	if proxy.ResolveErrors() != 1 || proxy.DialErrors() != 0 {
+		t.Fatalf("Expected 1 resolve error, got %d resolve and %d dial errors", proxy.ResolveErrors(), proxy.DialErrors())
+	}
+
+	// Nothing listens on port 20009, as in TestProxyToDownUpstream
+	down := NewTestProxy("down", "down.toxiproxy.test:20009")
+	down.resolver = NewResolver(dns.Addr, 0)
+	down.Start()
+	defer down.Stop()
+
+	conn = AssertProxyUp(t, down.Listen, true)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected proxy to close client when upstream is down, got", err)
+	}
+	if down.ResolveErrors() != 0 || down.DialErrors() != 1 {
+		t.Fatalf("Expected 1 dial error, got %d resolve and %d dial errors", down.ResolveErrors(), down.DialErrors())
+	}
+}
+
+// A toxic acting on lookups which finds no addresses, without an error.
+type EmptyResolveToxic struct{}
+
+func (t *EmptyResolveToxic) Name() string            { return "empty_resolve" }
+func (t *EmptyResolveToxic) IsEnabled() bool         { return true }
+func (t *EmptyResolveToxic) SetEnabled(enabled bool) {}
+func (t *EmptyResolveToxic) Validate() []FieldError  { return nil }
+func (t *EmptyResolveToxic) Pipe(stub *ToxicStub)    { new(NoopToxic).Pipe(stub) }
+
+func (t *EmptyResolveToxic) Resolve(ctx context.Context, upstream string, lookup func(context.Context, string) ([]string, error)) ([]string, error) {
+	return []string{}, nil
+}
+
+func TestProxyCountsEmptyLookups(t *testing.T) {
+	proxy := NewTestProxy("test", "localhost:20009")
+	proxy.upToxics.toxics = append(proxy.upToxics.toxics, new(EmptyResolveToxic))
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn := AssertProxyUp(t, proxy.Listen, true)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected proxy to close client when the lookup found no addresses, got", err)
+	}
+	if proxy.ResolveErrors() != 1 || proxy.DialErrors() != 0 {
+		t.Fatalf("Expected 1 resolve error, got %d resolve and %d dial errors", proxy.ResolveErrors(), proxy.DialErrors())
+	}
+}
+
+func TestProxySRVUpstream(t *testing.T) {
+	WithTCPServer(t, func(upstream string, response chan []byte) {
+		_, port, _ := net.SplitHostPort(upstream)
+		portNumber, _ := strconv.Atoi(port)
+
+		dns := NewTestDNSServer(t)
+		defer dns.Close()
+		dns.SetHost("db.toxiproxy.test", "127.0.0.1")
+		dns.SetService("_db._tcp.toxiproxy.test", net.SRV{Target: "db.toxiproxy.test", Port: uint16(portNumber)})
+
+		proxy := NewTestProxy("test", "srv://_db._tcp.toxiproxy.test")
+		proxy.resolver = NewResolver(dns.Addr, 0)
+		proxy.Start()
+		defer proxy.Stop()
+
+		conn := AssertProxyUp(t, proxy.Listen, true)
+		conn.Write([]byte("hello"))
+		conn.Close()
+		if resp := <-response; string(resp) != "hello" {
+			t.Fatalf("Expected upstream to receive hello, got %q", resp)
+		}
+	})
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"runtime"
 	"testing"
+
+	"github.com/Shopify/toxiproxy"
 )
 
 // Benchmark numbers:
@@ -83,3 +88,84 @@ func BenchmarkProxySmall(b *testing.B) {
 		resp.Body.Close()
 	}
 }
+
+// Pipeline numbers, before and after pooling buffers:
+//     BenchmarkPipelineLatency      166 -> 0.5 allocs/MB
+//     BenchmarkPipelineSlicer      6378 -> 6312 allocs/MB
+//     BenchmarkPipelineBandwidth    128 -> 33 allocs/MB
+
+// Writes 32KB at a time through a proxy running in this process, with the
+// toxics enabled upstream. Unlike the benchmarks above, this doesn't need
+// the servers running, and reports the allocations per MB proxied.
+func benchmarkPipeline(b *testing.B, toxics ...toxiproxy.Toxic) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	server := toxiproxy.NewServer()
+	defer server.Close()
+	proxy, err := server.CreateProxy("benchmark", "localhost:0", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, toxic := range toxics {
+		err = proxy.AddToxic(toxiproxy.Upstream, toxic)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = conn.Write(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn.Close()
+	<-done
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+
+	megabytes := float64(b.N*len(buf)) / (1024 * 1024)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/megabytes, "allocs/MB")
+}
+
+// With every toxic disabled, the connections are spliced together.
+func BenchmarkPipelineNoToxics(b *testing.B) {
+	benchmarkPipeline(b)
+}
+
+func BenchmarkPipelineLatency(b *testing.B) {
+	benchmarkPipeline(b, &toxiproxy.LatencyToxic{})
+}
+
+func BenchmarkPipelineSlicer(b *testing.B) {
+	benchmarkPipeline(b, &toxiproxy.SlicerToxic{AverageSize: 1024, SizeVariation: 512})
+}
+
+func BenchmarkPipelineBandwidth(b *testing.B) {
+	benchmarkPipeline(b, &toxiproxy.BandwidthToxic{Rate: 10 * 1000 * 1000})
+}
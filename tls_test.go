@@ -0,0 +1,160 @@
+package toxiproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tclient "github.com/Shopify/toxiproxy/client"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	keyPair tls.Certificate
+}
+
+// Generates a certificate for 127.0.0.1, signed by parent. A nil parent makes
+// a self-signed CA.
+func GenerateCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to generate key", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal("Failed to create certificate", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Failed to parse certificate", err)
+	}
+	return &testCertificate{cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+// Writes the certificate and key as PEM files, returning their paths.
+func (c *testCertificate) Write(t *testing.T, dir, name string) (string, string) {
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal("Failed to marshal key", err)
+	}
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0644)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certPath, keyPath
+}
+
+// Runs an API server over TLS, passing the path of the CA certificate, and the
+// client certificate it signed.
+func WithTLSServer(t *testing.T, mutual bool, f func(addr, ca string, clientCert tls.Certificate)) {
+	dir, err := ioutil.TempDir("", "toxiproxy")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := GenerateCertificate(t, "toxiproxy-test-ca", nil)
+	caPath, _ := ca.Write(t, dir, "ca")
+	certPath, keyPath := GenerateCertificate(t, "toxiproxy", ca).Write(t, dir, "server")
+	client := GenerateCertificate(t, "client", ca)
+
+	clientCA := ""
+	if mutual {
+		clientCA = caPath
+	}
+	config, err := LoadTLSConfig(certPath, keyPath, clientCA)
+	if err != nil {
+		t.Fatal("Failed to load TLS config", err)
+	}
+
+	server := NewServer()
+	httpServer := httptest.NewUnstartedServer(server.Handler())
+	httpServer.TLS = config
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	f(httpServer.URL, caPath, client.keyPair)
+}
+
+func TestLoadTLSConfigMissingFiles(t *testing.T) {
+	_, err := LoadTLSConfig("/nonexistent.crt", "/nonexistent.key", "")
+	if err == nil {
+		t.Fatal("Expected error loading missing certificate")
+	}
+}
+
+func TestClientCABundle(t *testing.T) {
+	WithTLSServer(t, false, func(addr, ca string, clientCert tls.Certificate) {
+		client := tclient.NewClient(addr)
+		_, err := client.Proxies(ctx)
+		if err == nil {
+			t.Fatal("Expected client to reject certificate from unknown CA")
+		}
+
+		client = tclient.NewClient(addr, tclient.WithCABundle(ca))
+		_, err = client.Proxies(ctx)
+		if err != nil {
+			t.Fatal("Expected client to trust certificate from CA bundle:", err)
+		}
+	})
+}
+
+func TestClientCABundleMissing(t *testing.T) {
+	client := tclient.NewClient("https://localhost:8474", tclient.WithCABundle("/nonexistent.crt"))
+	_, err := client.Proxies(ctx)
+	if !os.IsNotExist(err) {
+		t.Fatal("Expected error loading missing CA bundle, got", err)
+	}
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	WithTLSServer(t, true, func(addr, ca string, clientCert tls.Certificate) {
+		client := tclient.NewClient(addr, tclient.WithCABundle(ca))
+		_, err := client.Proxies(ctx)
+		if err == nil {
+			t.Fatal("Expected server to require a client certificate")
+		}
+
+		client = tclient.NewClient(addr,
+			tclient.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{clientCert}}),
+			tclient.WithCABundle(ca),
+		)
+		_, err = client.Proxies(ctx)
+		if err != nil {
+			t.Fatal("Expected server to accept client certificate:", err)
+		}
+	})
+}
@@ -1,4 +1,9 @@
-package main
+package toxiproxy
+
+import (
+	"context"
+	"strings"
+)
 
 // A Toxic is something that can be attatched to a link to modify the way
 // data can be passed through (for example, by adding latency)
@@ -13,6 +18,13 @@ package main
 // per-connection information. This allows the same toxic to be used
 // for multiple connections.
 
+// Directions a toxic can be applied in. Upstream toxics affect data sent by the
+// client, downstream toxics affect data sent by the upstream.
+const (
+	Upstream   = "upstream"
+	Downstream = "downstream"
+)
+
 type Toxic interface {
 	// Return the unique name of the toxic, as used by the json api.
 	Name() string
@@ -25,22 +37,67 @@ type Toxic interface {
 
 	// Defines how packets flow through a ToxicStub. Pipe() blocks until the link is closed or interrupted.
 	Pipe(*ToxicStub)
+
+	// Returns a list of invalid fields, checked before the toxic is added to the chain.
+	Validate() []FieldError
+}
+
+// A DatagramToxic only makes sense for datagram protocols, such as a toxic that
+// reorders or duplicates chunks, which would corrupt a TCP stream. It can't be
+// enabled on a proxy for a stream protocol.
+type DatagramToxic interface {
+	Toxic
+	DatagramOnly()
+}
+
+// A ResolveToxic acts when the upstream of a new client is looked up, rather
+// than on the data of the connection, so it can only be enabled upstream.
+type ResolveToxic interface {
+	Toxic
+	// Resolve returns the addresses to dial for the upstream, normally by calling
+	// lookup, or an error to fail the lookup with. The lookup should be given up
+	// once ctx is done, when the proxy stops.
+	Resolve(ctx context.Context, upstream string, lookup func(context.Context, string) ([]string, error)) ([]string, error)
+}
+
+// A FieldError describes why a field of a toxic is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
+// A ValidationError is returned when setting a toxic with invalid fields.
+type ValidationError []FieldError
+
+func (errs ValidationError) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Field + " " + err.Message
+	}
+	return "Invalid toxic: " + strings.Join(messages, ", ")
+}
+
+// A ToxicStub connects a toxic to the rest of the chain for one connection.
+// Toxics read chunks from Input and write them to Output. A nil chunk on Input
+// means the connection was closed, and the toxic should call Close(). Receiving
+// from Interrupt means the toxic must return from Pipe() without closing the
+// stub, since it's being replaced.
 type ToxicStub struct {
-	input     <-chan *StreamChunk
-	output    chan<- *StreamChunk
-	interrupt chan struct{}
+	Input     <-chan *StreamChunk
+	Output    chan<- *StreamChunk
+	Interrupt chan struct{}
 	running   chan struct{}
 	closed    chan struct{}
+	// Set by CloseWrite() before closing the stub
+	halfClosed bool
 }
 
 func NewToxicStub(input <-chan *StreamChunk, output chan<- *StreamChunk) *ToxicStub {
 	return &ToxicStub{
-		interrupt: make(chan struct{}),
+		Interrupt: make(chan struct{}),
 		closed:    make(chan struct{}),
-		input:     input,
-		output:    output,
+		Input:     input,
+		Output:    output,
 	}
 }
 
@@ -53,11 +110,11 @@ func (s *ToxicStub) Run(toxic Toxic) {
 
 // Interrupt the flow of data so that the toxic controlling the stub can be replaced.
 // Returns true if the stream was successfully interrupted.
-func (s *ToxicStub) Interrupt() bool {
+func (s *ToxicStub) InterruptToxic() bool {
 	select {
 	case <-s.closed:
 		return false
-	case s.interrupt <- struct{}{}:
+	case s.Interrupt <- struct{}{}:
 		<-s.running // Wait for the running toxic to exit
 		return true
 	}
@@ -65,5 +122,20 @@ func (s *ToxicStub) Interrupt() bool {
 
 func (s *ToxicStub) Close() {
 	close(s.closed)
-	close(s.output)
+	close(s.Output)
+}
+
+// CloseWrite closes the stub like Close(), but only the write side of the
+// link's destination connection is then closed, sending a FIN while the other
+// direction stays open. Use Discard() to keep reading from the source.
+func (s *ToxicStub) CloseWrite() {
+	s.halfClosed = true
+	s.Close()
+}
+
+// Discard throws away everything left in Input after the stub was closed, so
+// the link keeps reading from its source until it closes.
+func (s *ToxicStub) Discard() {
+	for range s.Input {
+	}
 }
@@ -1,12 +1,32 @@
-package main
+package toxiproxy
 
-import "time"
+import (
+	"math"
+	"sync"
+	"time"
+)
 
-// The BandwidthToxic passes data through at a limited rate
+// Scopes of the BandwidthToxic's limit
+const (
+	BandwidthConnection = "connection"
+	BandwidthProxy      = "proxy"
+)
+
+// The BandwidthToxic passes data through at a limited rate, using a token
+// bucket that allows bursts of up to Burst KB after being idle. With the proxy
+// scope, every connection of the proxy shares one bucket in each direction,
+// like a saturated uplink.
 type BandwidthToxic struct {
 	Enabled bool `json:"enabled"`
 	// Rate in KB/s
 	Rate int64 `json:"rate"`
+	// Size of the bucket in KB
+	Burst int64 `json:"burst"`
+	// Whether each connection is limited separately, or all of them together
+	Scope string `json:"scope"`
+
+	// Shared by every link with the proxy scope, kept when the toxic is updated
+	bucket *tokenBucket
 }
 
 func (t *BandwidthToxic) Name() string {
@@ -21,44 +41,103 @@ func (t *BandwidthToxic) SetEnabled(enabled bool) {
 	t.Enabled = enabled
 }
 
+func (t *BandwidthToxic) Validate() (errs []FieldError) {
+	// A rate of 0 would never let any data through
+	if t.Enabled && t.Rate <= 0 {
+		errs = append(errs, FieldError{"rate", "must be greater than 0"})
+	}
+	if t.Burst < 0 {
+		errs = append(errs, FieldError{"burst", "must not be negative"})
+	}
+	if t.Scope != "" && t.Scope != BandwidthConnection && t.Scope != BandwidthProxy {
+		errs = append(errs, FieldError{"scope", "must be connection or proxy"})
+	}
+	return
+}
+
+func (t *BandwidthToxic) share(old Toxic) {
+	if old, ok := old.(*BandwidthToxic); ok && old.bucket != nil {
+		if t.bucket != old.bucket {
+			t.bucket = old.bucket
+		}
+	} else if t.bucket == nil {
+		t.bucket = new(tokenBucket)
+	}
+}
+
+// A tokenBucket holds the number of bytes that can be sent right away. Sending
+// more puts the bucket in debt, which the sender waits out.
+type tokenBucket struct {
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Takes size bytes from the bucket, returning how long to wait before sending
+// them. The rate is in bytes per second, and the bucket starts with burst bytes.
+func (b *tokenBucket) take(size int, rate, burst float64) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		// time.After only has ~1ms precision, so always allow a small burst to
+		// make up for sleeping too long
+		capacity := math.Max(burst, rate/100)
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+
+	b.tokens -= float64(size)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
 func (t *BandwidthToxic) Pipe(stub *ToxicStub) {
-	var sleep time.Duration = 0
+	bucket := t.bucket
+	if bucket == nil || t.Scope != BandwidthProxy {
+		bucket = new(tokenBucket)
+	}
+
 	for {
 		select {
-		case <-stub.interrupt:
+		case <-stub.Interrupt:
 			return
-		case p := <-stub.input:
+		case p := <-stub.Input:
 			if p == nil {
 				stub.Close()
 				return
 			}
 			if t.Rate <= 0 {
-				sleep = 0
-			} else {
-				sleep += time.Duration(len(p.data)) * time.Millisecond / time.Duration(t.Rate)
+				stub.Output <- p
+				continue
 			}
+
 			// If the rate is low enough, split the packet up and send in 100 millisecond intervals
-			for int64(len(p.data)) > t.Rate*100 {
-				select {
-				case <-time.After(100 * time.Millisecond):
-					stub.output <- &StreamChunk{p.data[:t.Rate*100], p.timestamp}
-					p.data = p.data[t.Rate*100:]
-					sleep -= 100 * time.Millisecond
-				case <-stub.interrupt:
-					stub.output <- p // Don't drop any data on the floor
-					return
+			for start := 0; start < len(p.Data); {
+				size := len(p.Data) - start
+				if int64(size) > t.Rate*100 {
+					size = int(t.Rate * 100)
 				}
+
+				wait := bucket.take(size, float64(t.Rate*1000), float64(t.Burst*1000))
+				if wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-stub.Interrupt:
+						stub.Output <- p.Slice(start, len(p.Data)) // Don't drop any data on the floor
+						p.Release()
+						return
+					}
+				}
+				stub.Output <- p.Slice(start, start+size)
+				start += size
 			}
-			start := time.Now()
-			select {
-			case <-time.After(sleep):
-				// time.After only seems to have ~1ms prevision, so offset the next sleep by the error
-				sleep -= time.Now().Sub(start)
-				stub.output <- p
-			case <-stub.interrupt:
-				stub.output <- p // Don't drop any data on the floor
-				return
-			}
+			p.Release()
 		}
 	}
 }
@@ -1,9 +1,13 @@
-package main
+package toxiproxy
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
 	"sync"
 )
 
@@ -15,16 +19,12 @@ type ToxicCollection struct {
 	chain  []Toxic
 	toxics []Toxic
 	links  map[string]*ToxicLink
+	// Whether the toxics apply to data sent by the upstream
+	downstream bool
 }
 
 func NewToxicCollection(proxy *Proxy) *ToxicCollection {
-	toxicOrder := []Toxic{
-		new(SlowCloseToxic),
-		new(LatencyToxic),
-		new(BandwidthToxic),
-		new(SlicerToxic),
-		new(TimeoutToxic),
-	}
+	toxicOrder := newToxics()
 
 	collection := &ToxicCollection{
 		noop:   new(NoopToxic),
@@ -63,34 +63,155 @@ func (c *ToxicCollection) SetToxicJson(name string, data io.Reader) (Toxic, erro
 
 	for index, toxic := range c.toxics {
 		if toxic.Name() == name {
-			err := json.NewDecoder(data).Decode(toxic)
+			toxic, err := updateToxic(toxic, data)
 			if err != nil {
 				return nil, err
 			}
+			if err := c.validate(toxic); err != nil {
+				return nil, err
+			}
 
-			c.setToxic(toxic, index)
+			c.replaceToxic(toxic, index)
 			return toxic, nil
 		}
 	}
 	return nil, fmt.Errorf("Bad toxic type: %s", name)
 }
 
+// Returns a copy of the toxic with the fields set in the JSON data replaced.
+// The fields are decoded into a new toxic rather than the copy, so the running
+// toxic's maps and slices are never written to, and a map or slice that's set
+// replaces the old one rather than being merged into it.
+func updateToxic(toxic Toxic, data io.Reader) (Toxic, error) {
+	body, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := newToxic(toxic.Name())
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Reject misspelled fields rather than silently ignoring them
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(decoded)
+	if err != nil {
+		return nil, err
+	}
+	var set map[string]json.RawMessage
+	json.Unmarshal(body, &set)
+
+	value := reflect.ValueOf(toxic).Elem()
+	copied := reflect.New(value.Type()).Elem()
+	copied.Set(value)
+	for i := 0; i < copied.NumField(); i++ {
+		field := copied.Type().Field(i)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		if key == "" {
+			key = field.Name
+		}
+		if field.PkgPath != "" || key == "-" {
+			continue
+		}
+		for name := range set {
+			// Field names match case insensitively, as when decoding
+			if strings.EqualFold(name, key) {
+				copied.Field(i).Set(reflect.ValueOf(decoded).Elem().Field(i))
+			}
+		}
+	}
+	return copied.Addr().Interface().(Toxic), nil
+}
+
 func (c *ToxicCollection) SetToxicValue(toxic Toxic) error {
 	c.Lock()
 	defer c.Unlock()
 
+	if err := c.validate(toxic); err != nil {
+		return err
+	}
+
 	for index, toxic2 := range c.toxics {
 		if toxic2.Name() == toxic.Name() {
-			c.setToxic(toxic, index)
+			c.replaceToxic(toxic, index)
 			return nil
 		}
 	}
 	return fmt.Errorf("Bad toxic type: %v", toxic)
 }
 
+// A wrappingToxic runs another toxic, which has to be able to run on the proxy
+// too. Returns nil if the toxic is invalid.
+type wrappingToxic interface {
+	wrapped() Toxic
+}
+
+// Checks the fields of the toxic, and that it can run on the proxy.
+func (c *ToxicCollection) validate(toxic Toxic) error {
+	errs := toxic.Validate()
+	if toxic.IsEnabled() {
+		for _, message := range c.unsupported(toxic) {
+			errs = append(errs, FieldError{"enabled", message})
+		}
+	}
+	if wrapper, ok := toxic.(wrappingToxic); ok && toxic.IsEnabled() {
+		if wrapped := wrapper.wrapped(); wrapped != nil {
+			for _, message := range c.unsupported(wrapped) {
+				errs = append(errs, FieldError{"toxic", wrapped.Name() + " " + message})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return ValidationError(errs)
+	}
+	return nil
+}
+
+// Returns why the toxic can't run on the proxy, if it can't.
+func (c *ToxicCollection) unsupported(toxic Toxic) (messages []string) {
+	if _, ok := toxic.(DatagramToxic); ok && !c.proxy.datagram() {
+		messages = append(messages, "is only supported on datagram proxies")
+	}
+	if _, ok := toxic.(ResolveToxic); ok && c.downstream {
+		messages = append(messages, "is only supported upstream")
+	}
+	return
+}
+
+// Disables the toxic with the given name, keeping its other fields.
+func (c *ToxicCollection) DisableToxic(name string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	for index, toxic := range c.toxics {
+		if toxic.Name() == name {
+			toxic.SetEnabled(false)
+			c.setToxic(toxic, index)
+			return nil
+		}
+	}
+	return fmt.Errorf("Bad toxic type: %s", name)
+}
+
+// A sharedToxic has state shared by every link in the collection, such as the
+// bucket of a bandwidth limit. The state is passed on when the toxic is updated.
+type sharedToxic interface {
+	share(old Toxic)
+}
+
+// Assumes lock has already been grabbed
+func (c *ToxicCollection) replaceToxic(toxic Toxic, index int) {
+	if shared, ok := toxic.(sharedToxic); ok {
+		shared.share(c.toxics[index])
+	}
+	c.toxics[index] = toxic
+	c.setToxic(toxic, index)
+}
+
 // Assumes lock has already been grabbed
 func (c *ToxicCollection) setToxic(toxic Toxic, index int) {
-	if !toxic.IsEnabled() {
+	if _, ok := toxic.(ResolveToxic); ok || !toxic.IsEnabled() {
+		// Toxics acting on lookups don't touch the data
 		c.chain[index] = c.noop
 	} else {
 		c.chain[index] = toxic
@@ -108,13 +229,48 @@ func (c *ToxicCollection) setToxic(toxic Toxic, index int) {
 	group.Wait()
 }
 
-func (c *ToxicCollection) StartLink(name string, input io.Reader, output io.WriteCloser) {
+// Returns the enabled toxics acting on lookups of the upstream, in chain order.
+func (c *ToxicCollection) resolveToxics() []ResolveToxic {
+	c.Lock()
+	defer c.Unlock()
+
+	var toxics []ResolveToxic
+	for _, toxic := range c.toxics {
+		if resolve, ok := toxic.(ResolveToxic); ok && toxic.IsEnabled() {
+			toxics = append(toxics, resolve)
+		}
+	}
+	return toxics
+}
+
+// Returns true if every toxic is disabled. Assumes lock has already been grabbed
+func (c *ToxicCollection) allNoop() bool {
+	for _, toxic := range c.chain {
+		if toxic != c.noop {
+			return false
+		}
+	}
+	return true
+}
+
+// Moves every link that's splicing its connections to running the toxics.
+func (c *ToxicCollection) StopSplicing() {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, link := range c.links {
+		link.stopSplicing()
+	}
+}
+
+func (c *ToxicCollection) StartLink(name string, input io.Reader, output io.WriteCloser) *ToxicLink {
 	c.Lock()
 	defer c.Unlock()
 
 	link := NewToxicLink(c.proxy, c)
 	link.Start(name, input, output)
 	c.links[name] = link
+	return link
 }
 
 func (c *ToxicCollection) RemoveLink(name string) {
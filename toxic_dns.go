@@ -0,0 +1,108 @@
+package toxiproxy
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// Modes of the DNSToxic.
+const (
+	DNSModeNXDomain = "nxdomain"
+	DNSModeServFail = "servfail"
+	DNSModeDelay    = "delay"
+	DNSModeRedirect = "redirect"
+)
+
+// The DNSToxic acts on the lookup of the upstream for a percentage of new
+// clients, before the upstream is dialed. Depending on Mode, the lookup fails
+// as if the name didn't exist (nxdomain) or the DNS server failed (servfail),
+// is slowed down by Delay milliseconds (delay), or returns Address instead of
+// the addresses of the upstream (redirect).
+type DNSToxic struct {
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode"`
+	// Percentage of clients whose lookup is affected
+	Probability float64 `json:"probability"`
+	Delay       int64   `json:"delay"`
+	// The IP the upstream resolves to in redirect mode. The default is
+	// reserved for documentation, so nothing answers on it
+	Address string `json:"address"`
+}
+
+func (t *DNSToxic) Name() string {
+	return "dns"
+}
+
+func (t *DNSToxic) IsEnabled() bool {
+	return t.Enabled
+}
+
+func (t *DNSToxic) SetEnabled(enabled bool) {
+	t.Enabled = enabled
+}
+
+func (t *DNSToxic) Validate() (errs []FieldError) {
+	switch t.Mode {
+	case DNSModeNXDomain, DNSModeServFail, DNSModeDelay, DNSModeRedirect:
+	default:
+		errs = append(errs, FieldError{"mode", "must be nxdomain, servfail, delay or redirect"})
+	}
+	if t.Probability < 0 || t.Probability > 100 {
+		errs = append(errs, FieldError{"probability", "must be between 0 and 100"})
+	}
+	if t.Delay < 0 {
+		errs = append(errs, FieldError{"delay", "must not be negative"})
+	}
+	if t.Mode == DNSModeRedirect && net.ParseIP(t.Address) == nil {
+		errs = append(errs, FieldError{"address", "must be an IP address"})
+	}
+	return
+}
+
+// The toxic doesn't touch the data of the connection.
+func (t *DNSToxic) Pipe(stub *ToxicStub) {
+	new(NoopToxic).Pipe(stub)
+}
+
+func (t *DNSToxic) Resolve(ctx context.Context, upstream string, lookup func(context.Context, string) ([]string, error)) ([]string, error) {
+	if rand.Float64()*100 >= t.Probability {
+		return lookup(ctx, upstream)
+	}
+
+	host, port, err := net.SplitHostPort(upstream)
+	if IsSRVUpstream(upstream) {
+		host = strings.TrimPrefix(upstream, srvScheme)
+	}
+
+	switch t.Mode {
+	case DNSModeNXDomain:
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	case DNSModeServFail:
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	case DNSModeDelay:
+		select {
+		case <-time.After(time.Duration(t.Delay) * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return lookup(ctx, upstream)
+	case DNSModeRedirect:
+		if !IsSRVUpstream(upstream) {
+			if err != nil {
+				return nil, err
+			}
+			return []string{net.JoinHostPort(t.Address, port)}, nil
+		}
+		// Keep the ports of the SRV targets
+		addrs, err := lookup(ctx, upstream)
+		for i, addr := range addrs {
+			_, port, _ := net.SplitHostPort(addr)
+			addrs[i] = net.JoinHostPort(t.Address, port)
+		}
+		return addrs, err
+	}
+	return lookup(ctx, upstream)
+}
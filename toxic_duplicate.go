@@ -0,0 +1,54 @@
+package toxiproxy
+
+import "math/rand"
+
+// The DuplicateToxic sends a percentage of chunks twice. Duplicating data
+// corrupts a stream, so it's only available on datagram proxies.
+type DuplicateToxic struct {
+	Enabled bool `json:"enabled"`
+	// Percentage of chunks to send twice
+	Probability float64 `json:"probability"`
+}
+
+func (t *DuplicateToxic) Name() string {
+	return "duplicate"
+}
+
+func (t *DuplicateToxic) IsEnabled() bool {
+	return t.Enabled
+}
+
+func (t *DuplicateToxic) SetEnabled(enabled bool) {
+	t.Enabled = enabled
+}
+
+func (t *DuplicateToxic) DatagramOnly() {}
+
+func (t *DuplicateToxic) Validate() (errs []FieldError) {
+	if t.Probability < 0 || t.Probability > 100 {
+		errs = append(errs, FieldError{"probability", "must be between 0 and 100"})
+	}
+	return
+}
+
+func (t *DuplicateToxic) Pipe(stub *ToxicStub) {
+	for {
+		select {
+		case <-stub.Interrupt:
+			return
+		case c := <-stub.Input:
+			if c == nil {
+				stub.Close()
+				return
+			}
+			if rand.Float64()*100 < t.Probability {
+				// Take another reference before c is sent on and can be released
+				duplicate := c.Slice(0, len(c.Data))
+				stub.Output <- c
+				stub.Output <- duplicate
+			} else {
+				stub.Output <- c
+			}
+		}
+	}
+}
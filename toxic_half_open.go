@@ -0,0 +1,57 @@
+package toxiproxy
+
+// Modes of the HalfOpenToxic
+const (
+	HalfOpenCloseWrite = "close_write"
+	HalfOpenBlackhole  = "blackhole"
+)
+
+// The HalfOpenToxic leaves the connection half open. In close_write mode, the
+// destination is sent a FIN while the other direction stays open. In blackhole
+// mode, both sides stay open, but all data is silently discarded, as if the
+// peer vanished without closing the connection. In either mode, data sent
+// from the source is accepted and thrown away.
+type HalfOpenToxic struct {
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode"`
+}
+
+func (t *HalfOpenToxic) Name() string {
+	return "half_open"
+}
+
+func (t *HalfOpenToxic) IsEnabled() bool {
+	return t.Enabled
+}
+
+func (t *HalfOpenToxic) SetEnabled(enabled bool) {
+	t.Enabled = enabled
+}
+
+func (t *HalfOpenToxic) Validate() (errs []FieldError) {
+	if t.Mode != HalfOpenCloseWrite && t.Mode != HalfOpenBlackhole {
+		errs = append(errs, FieldError{"mode", "must be close_write or blackhole"})
+	}
+	return
+}
+
+func (t *HalfOpenToxic) Pipe(stub *ToxicStub) {
+	if t.Mode == HalfOpenCloseWrite {
+		// The FIN can't be taken back, so this can't be interrupted anymore
+		stub.CloseWrite()
+		stub.Discard()
+		return
+	}
+
+	for {
+		select {
+		case <-stub.Interrupt:
+			return
+		case c := <-stub.Input:
+			if c == nil {
+				stub.Close()
+				return
+			}
+		}
+	}
+}
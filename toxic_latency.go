@@ -1,16 +1,40 @@
-package main
+package toxiproxy
 
 import (
+	"math"
 	"math/rand"
 	"time"
 )
 
+// Distributions of the LatencyToxic's jitter
+const (
+	DistributionUniform      = "uniform"
+	DistributionNormal       = "normal"
+	DistributionPareto       = "pareto"
+	DistributionParetoNormal = "pareto_normal"
+	DistributionEmpirical    = "empirical"
+)
+
 // The LatencyToxic passes data through with the a delay of latency +/- jitter added.
 type LatencyToxic struct {
 	Enabled bool `json:"enabled"`
 	// Times in milliseconds
 	Latency int64 `json:"latency"`
 	Jitter  int64 `json:"jitter"`
+	// How jitter is distributed around the latency, uniform if empty. The
+	// normal and pareto distributions use jitter as the standard deviation.
+	Distribution string `json:"distribution"`
+	// Percentage each delay depends on the previous one, so latency drifts
+	Correlation float64 `json:"correlation"`
+	// The delays to pick from with the empirical distribution
+	Histogram []HistogramBucket `json:"histogram"`
+}
+
+// A HistogramBucket is a delay in an empirical latency distribution, picked
+// with a probability proportional to its weight.
+type HistogramBucket struct {
+	Latency int64   `json:"latency"`
+	Weight  float64 `json:"weight"`
 }
 
 func (t *LatencyToxic) Name() string {
@@ -25,32 +49,140 @@ func (t *LatencyToxic) SetEnabled(enabled bool) {
 	t.Enabled = enabled
 }
 
-func (t *LatencyToxic) delay() time.Duration {
+func (t *LatencyToxic) Validate() (errs []FieldError) {
+	if t.Latency < 0 {
+		errs = append(errs, FieldError{"latency", "must not be negative"})
+	}
+	if t.Jitter < 0 {
+		errs = append(errs, FieldError{"jitter", "must not be negative"})
+	}
+	switch t.Distribution {
+	case "", DistributionUniform, DistributionNormal, DistributionPareto, DistributionParetoNormal:
+	case DistributionEmpirical:
+		if len(t.Histogram) == 0 {
+			errs = append(errs, FieldError{"histogram", "must not be empty with the empirical distribution"})
+		}
+	default:
+		errs = append(errs, FieldError{"distribution", "must be uniform, normal, pareto, pareto_normal or empirical"})
+	}
+	if t.Correlation < 0 || t.Correlation > 100 {
+		errs = append(errs, FieldError{"correlation", "must be between 0 and 100"})
+	}
+	for _, bucket := range t.Histogram {
+		if bucket.Latency < 0 || bucket.Weight < 0 {
+			errs = append(errs, FieldError{"histogram", "must not have negative latencies or weights"})
+			break
+		}
+	}
+	return
+}
+
+// Standard deviation of a pareto distribution with a shape of 3 and scale of 1,
+// which has a mean of 1.5.
+var paretoStdDev = math.Sqrt(0.75)
+
+// A latencySampler picks the delays for one connection, remembering the last
+// random numbers to correlate the next ones with.
+type latencySampler struct {
+	toxic  *LatencyToxic
+	random *rand.Rand
+	last   [2]float64
+	count  int
+}
+
+// Returns a sampler picking delays with the given source of random numbers,
+// which is only used by the sampler.
+func (t *LatencyToxic) sampler(random *rand.Rand) *latencySampler {
+	return &latencySampler{toxic: t, random: random}
+}
+
+// Returns a random number in (0, 1), correlated with the last one of the
+// stream. The correlation mixes in the last number like netem does.
+func (s *latencySampler) uniform(stream int) float64 {
+	u := s.random.Float64()
+	if s.count > 0 {
+		correlation := s.toxic.Correlation / 100
+		u = (1-correlation)*u + correlation*s.last[stream]
+	}
+	s.last[stream] = u
+	// Avoid infinities in the inverse distributions
+	return math.Min(math.Max(u, 1e-9), 1-1e-9)
+}
+
+// Standard normal and pareto samples, with a mean of 0 and deviation of 1.
+func (s *latencySampler) normal(stream int) float64 {
+	return math.Sqrt2 * math.Erfinv(2*s.uniform(stream)-1)
+}
+
+func (s *latencySampler) pareto(stream int) float64 {
+	return (math.Pow(1-s.uniform(stream), -1.0/3) - 1.5) / paretoStdDev
+}
+
+func (s *latencySampler) delay() time.Duration {
+	defer func() { s.count++ }()
+
+	t := s.toxic
+	var deviation float64
+	switch t.Distribution {
+	case DistributionNormal:
+		deviation = s.normal(0)
+	case DistributionPareto:
+		deviation = s.pareto(0)
+	case DistributionParetoNormal:
+		// Like netem, a quarter pareto and three quarters normal
+		deviation = (0.25*s.pareto(0) + 0.75*s.normal(1)) / math.Sqrt(0.25*0.25+0.75*0.75)
+	case DistributionEmpirical:
+		return time.Duration(s.empirical()) * time.Millisecond
+	default:
+		deviation = 2*s.uniform(0) - 1
+	}
+
 	// Delay = t.Latency +/- t.Jitter
-	delay := t.Latency
-	jitter := int64(t.Jitter)
-	if jitter > 0 {
-		delay += rand.Int63n(jitter*2) - jitter
+	delay := float64(t.Latency) + deviation*float64(t.Jitter)
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay * float64(time.Millisecond))
+}
+
+// Picks a latency from the histogram, weighted by each bucket.
+func (s *latencySampler) empirical() int64 {
+	total := 0.0
+	for _, bucket := range s.toxic.Histogram {
+		total += bucket.Weight
+	}
+	pick := s.uniform(0) * total
+	for _, bucket := range s.toxic.Histogram {
+		pick -= bucket.Weight
+		if pick < 0 {
+			return bucket.Latency
+		}
 	}
-	return time.Duration(delay) * time.Millisecond
+	return s.toxic.Histogram[len(s.toxic.Histogram)-1].Latency
 }
 
 func (t *LatencyToxic) Pipe(stub *ToxicStub) {
+	// Seeded from the global source, so -seed still makes runs repeatable
+	sampler := t.sampler(rand.New(rand.NewSource(rand.Int63())))
 	for {
 		select {
-		case <-stub.interrupt:
+		case <-stub.Interrupt:
 			return
-		case c := <-stub.input:
+		case c := <-stub.Input:
 			if c == nil {
 				stub.Close()
 				return
 			}
-			sleep := t.delay() - time.Now().Sub(c.timestamp)
+			sleep := sampler.delay() - time.Now().Sub(c.Timestamp)
+			if sleep <= 0 {
+				stub.Output <- c // Skip allocating a timer
+				continue
+			}
 			select {
 			case <-time.After(sleep):
-				stub.output <- c
-			case <-stub.interrupt:
-				stub.output <- c // Don't drop any data on the floor
+				stub.Output <- c
+			case <-stub.Interrupt:
+				stub.Output <- c // Don't drop any data on the floor
 				return
 			}
 		}
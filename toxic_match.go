@@ -0,0 +1,247 @@
+package toxiproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+)
+
+// The MatchToxic passes data through unchanged until Pattern or Regexp is seen
+// in the stream, and from then on runs Toxic with Attributes for the rest of
+// the connection. The chunk completing the match is the first one passed to
+// the toxic. Data is buffered across chunks, so a pattern split up by the
+// slicer toxic still matches. Regexp only sees the last Window bytes before
+// each chunk.
+type MatchToxic struct {
+	Enabled bool   `json:"enabled"`
+	Pattern string `json:"pattern"`
+	Regexp  string `json:"regexp"`
+	Window  int    `json:"window"`
+	// The name and fields of the toxic to run once the stream matches
+	Toxic      string                 `json:"toxic"`
+	Attributes map[string]interface{} `json:"attributes"`
+
+	// The toxic run by every link once it matches, made when the toxic is set
+	inner Toxic
+}
+
+func (t *MatchToxic) Name() string {
+	return "match"
+}
+
+func (t *MatchToxic) IsEnabled() bool {
+	return t.Enabled
+}
+
+func (t *MatchToxic) SetEnabled(enabled bool) {
+	t.Enabled = enabled
+}
+
+func (t *MatchToxic) Validate() (errs []FieldError) {
+	if t.Pattern != "" && t.Regexp != "" {
+		errs = append(errs, FieldError{"regexp", "can't be set with pattern"})
+	} else if t.Enabled && t.Pattern == "" && t.Regexp == "" {
+		errs = append(errs, FieldError{"pattern", "or regexp must be set"})
+	}
+	if t.Regexp != "" {
+		_, err := regexp.Compile(t.Regexp)
+		if err != nil {
+			errs = append(errs, FieldError{"regexp", err.Error()})
+		}
+		if t.Window <= 0 {
+			errs = append(errs, FieldError{"window", "must be greater than 0"})
+		}
+	}
+
+	if t.Toxic == t.Name() {
+		errs = append(errs, FieldError{"toxic", "can't be match"})
+	} else if t.Enabled && t.Toxic == "" {
+		errs = append(errs, FieldError{"toxic", "must be set"})
+	} else if t.Toxic != "" {
+		toxic, err := t.toxic()
+		if _, ok := toxic.(ResolveToxic); ok {
+			errs = append(errs, FieldError{"toxic", "can't act on lookups"})
+		} else if fields, ok := err.(ValidationError); ok {
+			// Report invalid attributes as fields of this toxic
+			for _, field := range fields {
+				errs = append(errs, FieldError{"attributes." + field.Field, field.Message})
+			}
+		} else if err != nil {
+			errs = append(errs, FieldError{"toxic", err.Error()})
+		}
+	}
+	return
+}
+
+// Returns a new, enabled toxic to run once the stream matches.
+func (t *MatchToxic) toxic() (Toxic, error) {
+	toxic, err := newToxic(t.Toxic)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(t.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(toxic)
+	if err != nil {
+		return nil, err
+	}
+
+	toxic.SetEnabled(true)
+	if errs := toxic.Validate(); len(errs) > 0 {
+		return nil, ValidationError(errs)
+	}
+	return toxic, nil
+}
+
+// Returns the toxic run once the stream matches, or nil if it's invalid.
+func (t *MatchToxic) wrapped() Toxic {
+	toxic, _ := t.toxic()
+	return toxic
+}
+
+// Makes the toxic run once the stream matches, passing on the state shared by
+// the links of the old toxic it replaces.
+func (t *MatchToxic) share(old Toxic) {
+	var previous Toxic
+	if old, ok := old.(*MatchToxic); ok {
+		previous = old.inner
+	}
+	t.inner = t.wrapped()
+	if shared, ok := t.inner.(sharedToxic); ok {
+		shared.share(previous)
+	}
+}
+
+// Returns a function reporting whether the stream matched, given each chunk.
+func (t *MatchToxic) matcher() func([]byte) bool {
+	var tail []byte
+	var matches func([]byte) bool
+	window := t.Window
+	if t.Regexp != "" {
+		matches = regexp.MustCompile(t.Regexp).Match
+	} else {
+		pattern := []byte(t.Pattern)
+		matches = func(data []byte) bool { return bytes.Contains(data, pattern) }
+		window = len(pattern) - 1
+	}
+
+	return func(data []byte) bool {
+		buf := append(tail, data...)
+		if matches(buf) {
+			return true
+		}
+		if len(buf) > window {
+			buf = buf[len(buf)-window:]
+		}
+		tail = append([]byte(nil), buf...)
+		return false
+	}
+}
+
+func (t *MatchToxic) Pipe(stub *ToxicStub) {
+	matches := t.matcher()
+	for {
+		select {
+		case <-stub.Interrupt:
+			return
+		case c := <-stub.Input:
+			if c == nil {
+				stub.Close()
+				return
+			}
+			if !matches(c.Data) {
+				stub.Output <- c
+				continue
+			}
+
+			toxic := t.inner
+			if toxic == nil {
+				toxic = t.wrapped()
+			}
+			if toxic == nil {
+				// Validated when set, so this can't happen
+				stub.Output <- c
+				continue
+			}
+			t.pipeMatched(stub, toxic, c)
+			return
+		}
+	}
+}
+
+// Runs toxic on a stub of its own for the rest of the connection, starting with
+// the chunk that matched.
+func (t *MatchToxic) pipeMatched(stub *ToxicStub, toxic Toxic, pending *StreamChunk) {
+	input := make(chan *StreamChunk)
+	output := make(chan *StreamChunk)
+	inner := NewToxicStub(input, output)
+
+	piped := make(chan struct{})
+	go func() {
+		defer close(piped)
+		toxic.Pipe(inner)
+	}()
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for c := range output {
+			stub.Output <- c
+		}
+	}()
+
+	closing := false
+	for {
+		var send chan<- *StreamChunk
+		var receive <-chan *StreamChunk
+		if pending != nil {
+			send = input
+		} else if !closing {
+			receive = stub.Input
+		}
+
+		select {
+		case send <- pending:
+			pending = nil
+		case c := <-receive:
+			if c == nil {
+				// The toxic closes its stub once it's done with the remaining data
+				close(input)
+				closing = true
+			}
+			pending = c
+		case <-forwarded:
+			// The toxic closed its stub, so it won't send anything else on
+			if pending != nil {
+				pending.Release()
+			}
+			if !closing {
+				close(input)
+			}
+			<-piped
+			if inner.halfClosed {
+				stub.CloseWrite()
+				stub.Discard()
+			} else {
+				stub.Close()
+			}
+			return
+		case <-stub.Interrupt:
+			select {
+			case inner.Interrupt <- struct{}{}:
+				<-piped
+				close(output)
+			case <-piped:
+			}
+			<-forwarded
+			if pending != nil {
+				stub.Output <- pending // Don't drop any data on the floor
+			}
+			return
+		}
+	}
+}
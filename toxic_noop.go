@@ -1,4 +1,4 @@
-package main
+package toxiproxy
 
 // The NoopToxic passes all data through without any toxic effects.
 type NoopToxic struct{}
@@ -16,14 +16,18 @@ func (t *NoopToxic) SetEnabled(enabled bool) {}
 func (t *NoopToxic) Pipe(stub *ToxicStub) {
 	for {
 		select {
-		case <-stub.interrupt:
+		case <-stub.Interrupt:
 			return
-		case c := <-stub.input:
+		case c := <-stub.Input:
 			if c == nil {
 				stub.Close()
 				return
 			}
-			stub.output <- c
+			stub.Output <- c
 		}
 	}
 }
+
+func (t *NoopToxic) Validate() []FieldError {
+	return nil
+}
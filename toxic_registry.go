@@ -0,0 +1,147 @@
+package toxiproxy
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The registry holds the constructor of every toxic type, in the order toxics
+// are chained together for each connection.
+var registry = struct {
+	sync.RWMutex
+	names        []string
+	constructors map[string]func() Toxic
+}{
+	constructors: make(map[string]func() Toxic),
+}
+
+func init() {
+	Register("slow_close", func() Toxic { return new(SlowCloseToxic) })
+	Register("latency", func() Toxic { return new(LatencyToxic) })
+	Register("bandwidth", func() Toxic { return &BandwidthToxic{Scope: BandwidthConnection} })
+	Register("slicer", func() Toxic { return new(SlicerToxic) })
+	Register("reorder", func() Toxic { return &ReorderToxic{Gap: 1, Timeout: 100} })
+	Register("duplicate", func() Toxic { return new(DuplicateToxic) })
+	Register("match", func() Toxic { return &MatchToxic{Window: 1024} })
+	Register("script", func() Toxic { return &ScriptToxic{Timeout: 100} })
+	Register("half_open", func() Toxic { return &HalfOpenToxic{Mode: HalfOpenCloseWrite} })
+	Register("timeout", func() Toxic { return new(TimeoutToxic) })
+	Register("dns", func() Toxic {
+		return &DNSToxic{Mode: DNSModeNXDomain, Probability: 100, Address: "192.0.2.1"}
+	})
+}
+
+// Register adds a toxic type, created disabled by constructor for each
+// direction of every new proxy. Toxics are chained in the order they were
+// registered, after the built-in ones. Register should be called from init(),
+// since proxies that already exist won't have the new toxic.
+//
+// Register panics if a toxic with the same name was already registered, or if
+// the name doesn't match the Name() of the toxic.
+func Register(name string, constructor func() Toxic) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, exists := registry.constructors[name]; exists {
+		panic("toxiproxy: Register called twice for toxic " + name)
+	}
+	if toxic := constructor(); toxic.Name() != name {
+		panic(fmt.Sprintf("toxiproxy: Register called with name %s for toxic %s", name, toxic.Name()))
+	}
+
+	registry.names = append(registry.names, name)
+	registry.constructors[name] = constructor
+}
+
+// Returns a new, disabled toxic of each registered type, in chain order.
+func newToxics() []Toxic {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	toxics := make([]Toxic, len(registry.names))
+	for i, name := range registry.names {
+		toxics[i] = registry.constructors[name]()
+	}
+	return toxics
+}
+
+// Returns a new, disabled toxic of the registered type with the given name.
+func newToxic(name string) (Toxic, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	constructor, exists := registry.constructors[name]
+	if !exists {
+		return nil, fmt.Errorf("Bad toxic type: %s", name)
+	}
+	return constructor(), nil
+}
+
+// A ToxicType describes the parameters of a registered toxic.
+type ToxicType struct {
+	Name   string       `json:"name"`
+	Fields []ToxicField `json:"fields"`
+}
+
+// A ToxicField is a parameter of a toxic, as set through the API.
+type ToxicField struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Default interface{} `json:"default"`
+}
+
+// ToxicTypes returns the schema of every registered toxic, in chain order.
+func ToxicTypes() []ToxicType {
+	toxics := newToxics()
+	types := make([]ToxicType, len(toxics))
+	for i, toxic := range toxics {
+		types[i] = ToxicType{Name: toxic.Name(), Fields: toxicFields(toxic)}
+	}
+	return types
+}
+
+// Lists the JSON fields of a toxic, with the values from its constructor as
+// the defaults.
+func toxicFields(toxic Toxic) []ToxicField {
+	value := reflect.ValueOf(toxic).Elem()
+	fields := []ToxicField{}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" {
+			continue // Unexported fields aren't set through the API
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = field.Name
+		}
+
+		fields = append(fields, ToxicField{
+			Name:    name,
+			Type:    jsonType(field.Type.Kind()),
+			Default: value.Field(i).Interface(),
+		})
+	}
+	return fields
+}
+
+func jsonType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
@@ -0,0 +1,102 @@
+package toxiproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// A toxic outside of the built-in ones, using only what another package could.
+type UppercaseToxic struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (t *UppercaseToxic) Name() string            { return "uppercase" }
+func (t *UppercaseToxic) IsEnabled() bool         { return t.Enabled }
+func (t *UppercaseToxic) SetEnabled(enabled bool) { t.Enabled = enabled }
+func (t *UppercaseToxic) Validate() []FieldError  { return nil }
+
+func (t *UppercaseToxic) Pipe(stub *ToxicStub) {
+	for {
+		select {
+		case <-stub.Interrupt:
+			return
+		case c := <-stub.Input:
+			if c == nil {
+				stub.Close()
+				return
+			}
+			stub.Output <- &StreamChunk{Data: bytes.ToUpper(c.Data), Timestamp: c.Timestamp}
+		}
+	}
+}
+
+func init() {
+	Register("uppercase", func() Toxic { return new(UppercaseToxic) })
+}
+
+func TestRegisteredToxic(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(func() { server.Close() })
+
+	proxy, err := server.CreateProxy("echo", "localhost:0", "mock://echo")
+	if err != nil {
+		t.Fatal("Failed to create proxy", err)
+	}
+	err = proxy.AddToxic(Upstream, new(UppercaseToxic))
+	if err != nil {
+		t.Fatal("Failed to add registered toxic", err)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	if err != nil {
+		t.Fatal("Failed writing to proxy", err)
+	}
+	buf := make([]byte, 6)
+	_, err = conn.Read(buf)
+	if err != nil {
+		t.Fatal("Failed reading from proxy", err)
+	}
+	if string(buf) != "HELLO\n" {
+		t.Fatalf("Expected registered toxic to change the data, got %q", buf)
+	}
+}
+
+func TestRegisterDuplicateToxic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected registering a toxic twice to panic")
+		}
+	}()
+	Register("latency", func() Toxic { return new(LatencyToxic) })
+}
+
+func TestToxicTypesSchema(t *testing.T) {
+	types := ToxicTypes()
+	names := []string{"slow_close", "latency", "bandwidth", "slicer", "reorder", "duplicate", "match", "script", "half_open", "timeout", "dns", "uppercase"}
+	if len(types) != len(names) {
+		t.Fatalf("Expected %d toxic types, got %+v", len(names), types)
+	}
+	for i, name := range names {
+		if types[i].Name != name {
+			t.Fatalf("Expected toxic %d to be %s, got %s", i, name, types[i].Name)
+		}
+	}
+
+	fields := types[1].Fields
+	if len(fields) != 6 ||
+		fields[0] != (ToxicField{"enabled", "boolean", false}) ||
+		fields[1] != (ToxicField{"latency", "integer", int64(0)}) ||
+		fields[2] != (ToxicField{"jitter", "integer", int64(0)}) ||
+		fields[3] != (ToxicField{"distribution", "string", ""}) ||
+		fields[4] != (ToxicField{"correlation", "number", float64(0)}) ||
+		fields[5].Name != "histogram" || fields[5].Type != "array" {
+		t.Fatalf("Unexpected latency fields: %+v", fields)
+	}
+}
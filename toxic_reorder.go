@@ -0,0 +1,87 @@
+package toxiproxy
+
+import (
+	"math/rand"
+	"time"
+)
+
+// The ReorderToxic holds back a percentage of chunks, and sends each one after
+// Gap later chunks, or after Timeout milliseconds if no more chunks arrive.
+// Reordering data corrupts a stream, so it's only available on datagram proxies.
+type ReorderToxic struct {
+	Enabled bool `json:"enabled"`
+	// Percentage of chunks to hold back
+	Probability float64 `json:"probability"`
+	// Number of chunks to send before a held back one
+	Gap int `json:"gap"`
+	// Time in milliseconds to hold a chunk back for at most
+	Timeout int64 `json:"timeout"`
+}
+
+func (t *ReorderToxic) Name() string {
+	return "reorder"
+}
+
+func (t *ReorderToxic) IsEnabled() bool {
+	return t.Enabled
+}
+
+func (t *ReorderToxic) SetEnabled(enabled bool) {
+	t.Enabled = enabled
+}
+
+func (t *ReorderToxic) DatagramOnly() {}
+
+func (t *ReorderToxic) Validate() (errs []FieldError) {
+	if t.Probability < 0 || t.Probability > 100 {
+		errs = append(errs, FieldError{"probability", "must be between 0 and 100"})
+	}
+	if t.Gap < 0 || (t.Enabled && t.Gap == 0) {
+		errs = append(errs, FieldError{"gap", "must be greater than 0"})
+	}
+	if t.Timeout < 0 || (t.Enabled && t.Timeout == 0) {
+		errs = append(errs, FieldError{"timeout", "must be greater than 0"})
+	}
+	return
+}
+
+func (t *ReorderToxic) Pipe(stub *ToxicStub) {
+	var held *StreamChunk
+	var release <-chan time.Time
+	gap := 0
+
+	for {
+		select {
+		case <-stub.Interrupt:
+			if held != nil {
+				stub.Output <- held // Don't drop any data on the floor
+			}
+			return
+		case <-release:
+			stub.Output <- held
+			held, release = nil, nil
+		case c := <-stub.Input:
+			if c == nil {
+				if held != nil {
+					stub.Output <- held
+				}
+				stub.Close()
+				return
+			}
+			if held == nil && rand.Float64()*100 < t.Probability {
+				held, gap = c, t.Gap
+				release = time.After(time.Duration(t.Timeout) * time.Millisecond)
+				continue
+			}
+
+			stub.Output <- c
+			if held != nil {
+				gap--
+				if gap == 0 {
+					stub.Output <- held
+					held, release = nil, nil
+				}
+			}
+		}
+	}
+}
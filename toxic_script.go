@@ -0,0 +1,388 @@
+package toxiproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// The ScriptToxic runs a Lua script to decide what happens to each chunk of
+// data. The script defines an on_chunk(data) function, called with each chunk
+// as a string, which can call the following functions:
+//
+//     pass()        Send the chunk on unchanged (the default if nothing else is called)
+//     send(data)    Send data instead of the chunk
+//     split(size)   Send the chunk in pieces of at most size bytes
+//     delay(ms)     Wait before anything sent after this call
+//     drop()        Don't send the chunk
+//     close()       Close the connection, after anything sent before this call
+//
+// Each connection runs its own copy of the script, so globals can be used to
+// keep state between chunks. Scripts can't access files, and each call can
+// run for at most Timeout milliseconds, up to maxScriptTimeout. A script that
+// fails or times out passes the chunk on unchanged.
+//
+// The timeout can't interrupt a single call into Go, so builtins that build
+// strings in one call can't build strings over maxScriptStringSize, and
+// string.gsub, which copies the whole string for each match, isn't available.
+// The memory a script uses isn't otherwise limited: repeatedly doubling a
+// string with the .. operator can allocate hundreds of megabytes before the
+// timeout, so only run scripts you trust.
+type ScriptToxic struct {
+	Enabled bool   `json:"enabled"`
+	Script  string `json:"script"`
+	// Time in milliseconds the script can run for, for each chunk
+	Timeout int64 `json:"timeout"`
+}
+
+func (t *ScriptToxic) Name() string {
+	return "script"
+}
+
+func (t *ScriptToxic) IsEnabled() bool {
+	return t.Enabled
+}
+
+func (t *ScriptToxic) SetEnabled(enabled bool) {
+	t.Enabled = enabled
+}
+
+func (t *ScriptToxic) Validate() (errs []FieldError) {
+	if t.Timeout < 0 || (t.Enabled && t.Timeout == 0) {
+		errs = append(errs, FieldError{"timeout", "must be greater than 0"})
+	} else if t.Timeout > maxScriptTimeout {
+		errs = append(errs, FieldError{"timeout", fmt.Sprintf("must be at most %d", maxScriptTimeout)})
+	}
+	if t.Enabled && t.Script == "" {
+		errs = append(errs, FieldError{"script", "must not be empty"})
+	} else if t.Script != "" {
+		chunk, err := parse.Parse(strings.NewReader(t.Script), "script")
+		if err == nil {
+			_, err = lua.Compile(chunk, "script")
+		}
+		if err != nil {
+			errs = append(errs, FieldError{"script", err.Error()})
+		}
+	}
+	return
+}
+
+const (
+	// The longest time in milliseconds a script can run for, for each chunk
+	maxScriptTimeout = 5000
+	// The largest string string.rep, string.format and table.concat can build
+	maxScriptStringSize = 1 << 20
+	// The most nested calls a script can make
+	maxScriptCallStack = 64
+	// The most values a script can have on its stack
+	maxScriptRegistry = 64 * 1024
+)
+
+type scriptAction struct {
+	chunk *StreamChunk // Sent if not nil
+	delay time.Duration
+	close bool
+}
+
+// A scriptState is the Lua state of the script for one connection.
+type scriptState struct {
+	toxic   *ScriptToxic
+	state   *lua.LState
+	actions []scriptAction
+	// The current chunk, and whether it was handled by a function other than delay()
+	chunk   *StreamChunk
+	handled bool
+}
+
+func (t *ScriptToxic) newState() (*scriptState, error) {
+	s := &scriptState{
+		toxic: t,
+		state: lua.NewState(lua.Options{
+			SkipOpenLibs:    true,
+			CallStackSize:   maxScriptCallStack,
+			RegistryMaxSize: maxScriptRegistry,
+		}),
+	}
+
+	// Only open the libraries without access to the file system or process
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		s.state.Push(s.state.NewFunction(lib.open))
+		s.state.Push(lua.LString(lib.name))
+		s.state.Call(1, 0)
+	}
+	s.state.SetGlobal("dofile", lua.LNil)
+	s.state.SetGlobal("loadfile", lua.LNil)
+	s.state.SetField(s.state.GetGlobal(lua.StringLibName), "gsub", lua.LNil)
+	s.limitSize(lua.StringLibName, "rep", repSize)
+	s.limitSize(lua.StringLibName, "format", formatSize)
+	s.limitSize(lua.TabLibName, "concat", concatSize)
+
+	for name, function := range map[string]lua.LGFunction{
+		"pass":  s.pass,
+		"send":  s.send,
+		"split": s.split,
+		"delay": s.delay,
+		"drop":  s.drop,
+		"close": s.close,
+	} {
+		s.state.SetGlobal(name, s.state.NewFunction(function))
+	}
+
+	err := s.withTimeout(func() error {
+		return s.state.DoString(t.Script)
+	})
+	if err != nil {
+		s.state.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Replaces a library function with one that raises an error instead of
+// building a string over maxScriptStringSize. The size function returns an
+// upper bound on the size of the string built for the arguments.
+func (s *scriptState) limitSize(lib, name string, size func(*lua.LState) int) {
+	table := s.state.GetGlobal(lib)
+	original := s.state.GetField(table, name)
+	s.state.SetField(table, name, s.state.NewFunction(func(state *lua.LState) int {
+		if size(state) > maxScriptStringSize {
+			state.RaiseError("%s.%s would build a string over %d bytes", lib, name, maxScriptStringSize)
+		}
+		args := state.GetTop()
+		state.Push(original)
+		for i := 1; i <= args; i++ {
+			state.Push(state.Get(i))
+		}
+		state.Call(args, lua.MultRet)
+		return state.GetTop() - args
+	}))
+}
+
+// Adds b to a, stopping at a value over maxScriptStringSize so sizes don't overflow.
+func addSize(a, b int) int {
+	if b > maxScriptStringSize-a {
+		return maxScriptStringSize + 1
+	}
+	return a + b
+}
+
+func repSize(state *lua.LState) int {
+	str := state.CheckString(1)
+	n := state.CheckInt(2)
+	if n <= 0 || len(str) == 0 {
+		return 0
+	}
+	if n > maxScriptStringSize/len(str) {
+		return maxScriptStringSize + 1
+	}
+	return len(str) * n
+}
+
+func formatSize(state *lua.LState) int {
+	format := state.CheckString(1)
+	size := len(format)
+	for i := 2; i <= state.GetTop(); i++ {
+		// Numbers format to at most a few hundred characters, before padding
+		arg := state.Get(i)
+		if str, ok := arg.(lua.LString); ok {
+			size = addSize(size, len(str))
+		} else {
+			size = addSize(size, 512)
+		}
+	}
+	// Add the width and precision of each verb
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		width := 0
+		for i++; i < len(format) && (format[i] >= '0' && format[i] <= '9' || strings.IndexByte("-+ #.", format[i]) >= 0); i++ {
+			if format[i] >= '0' && format[i] <= '9' {
+				width = addSize(width*10, int(format[i]-'0'))
+			} else if width > 0 {
+				size = addSize(size, width)
+				width = 0
+			}
+		}
+		size = addSize(size, width)
+	}
+	return size
+}
+
+func concatSize(state *lua.LState) int {
+	table := state.CheckTable(1)
+	sep := state.OptString(2, "")
+	first := state.OptInt(3, 1)
+	last := state.OptInt(4, table.Len())
+	if first < 1 {
+		first = 1
+	}
+	if last > table.Len() {
+		last = table.Len()
+	}
+
+	size := 0
+	for i := first; i <= last && size <= maxScriptStringSize; i++ {
+		size = addSize(size, len(lua.LVAsString(table.RawGetInt(i))))
+		if i < last {
+			size = addSize(size, len(sep))
+		}
+	}
+	return size
+}
+
+func (s *scriptState) withTimeout(f func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.toxic.Timeout)*time.Millisecond)
+	defer cancel()
+	s.state.SetContext(ctx)
+	defer s.state.RemoveContext()
+	return f()
+}
+
+// Runs on_chunk for the chunk, returning what should be done with it. The
+// chunks of the actions are slices or copies of the chunk, so the chunk itself
+// can be released once this returns.
+func (s *scriptState) run(c *StreamChunk) ([]scriptAction, error) {
+	s.actions = nil
+	s.chunk = c
+	s.handled = false
+
+	handler := s.state.GetGlobal("on_chunk")
+	if handler.Type() != lua.LTFunction {
+		return []scriptAction{{chunk: c.Slice(0, len(c.Data))}}, nil
+	}
+	err := s.withTimeout(func() error {
+		return s.state.CallByParam(lua.P{Fn: handler, Protect: true}, lua.LString(c.Data))
+	})
+	if err != nil {
+		for _, action := range s.actions {
+			if action.chunk != nil {
+				action.chunk.Release()
+			}
+		}
+		return []scriptAction{{chunk: c.Slice(0, len(c.Data))}}, err
+	}
+
+	if !s.handled {
+		s.actions = append(s.actions, scriptAction{chunk: c.Slice(0, len(c.Data))})
+	}
+	return s.actions, nil
+}
+
+func (s *scriptState) pass(state *lua.LState) int {
+	s.handled = true
+	s.actions = append(s.actions, scriptAction{chunk: s.chunk.Slice(0, len(s.chunk.Data))})
+	return 0
+}
+
+func (s *scriptState) send(state *lua.LState) int {
+	s.handled = true
+	if data := state.CheckString(1); data != "" {
+		chunk := newStreamChunk([]byte(data))
+		chunk.Timestamp = s.chunk.Timestamp
+		s.actions = append(s.actions, scriptAction{chunk: chunk})
+	}
+	return 0
+}
+
+func (s *scriptState) split(state *lua.LState) int {
+	size := state.CheckInt(1)
+	if size <= 0 {
+		state.ArgError(1, "size must be greater than 0")
+	}
+	s.handled = true
+	for start := 0; start < len(s.chunk.Data); start += size {
+		end := start + size
+		if end > len(s.chunk.Data) {
+			end = len(s.chunk.Data)
+		}
+		s.actions = append(s.actions, scriptAction{chunk: s.chunk.Slice(start, end)})
+	}
+	return 0
+}
+
+func (s *scriptState) delay(state *lua.LState) int {
+	s.actions = append(s.actions, scriptAction{delay: time.Duration(state.CheckInt64(1)) * time.Millisecond})
+	return 0
+}
+
+func (s *scriptState) drop(state *lua.LState) int {
+	s.handled = true
+	return 0
+}
+
+func (s *scriptState) close(state *lua.LState) int {
+	s.handled = true
+	s.actions = append(s.actions, scriptAction{close: true})
+	return 0
+}
+
+func (t *ScriptToxic) Pipe(stub *ToxicStub) {
+	state, err := t.newState()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("Script toxic failed to start, passing data through")
+	} else {
+		defer state.state.Close()
+	}
+
+	for {
+		select {
+		case <-stub.Interrupt:
+			return
+		case c := <-stub.Input:
+			if c == nil {
+				stub.Close()
+				return
+			}
+			if state == nil {
+				stub.Output <- c
+				continue
+			}
+
+			actions, err := state.run(c)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"err": err,
+				}).Warn("Script toxic failed, passing chunk through")
+			}
+			c.Release()
+
+			for i, action := range actions {
+				if action.close {
+					stub.Close()
+					return
+				} else if action.chunk != nil {
+					stub.Output <- action.chunk
+					continue
+				}
+
+				select {
+				case <-time.After(action.delay):
+				case <-stub.Interrupt:
+					// Don't drop any data on the floor
+					for _, action := range actions[i+1:] {
+						if action.chunk != nil {
+							stub.Output <- action.chunk
+						}
+					}
+					return
+				}
+			}
+		}
+	}
+}
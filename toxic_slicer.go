@@ -1,4 +1,4 @@
-package main
+package toxiproxy
 
 import (
 	"math/rand"
@@ -31,6 +31,21 @@ func (t *SlicerToxic) SetEnabled(enabled bool) {
 	t.Enabled = enabled
 }
 
+func (t *SlicerToxic) Validate() (errs []FieldError) {
+	if t.Enabled && t.AverageSize <= 0 {
+		errs = append(errs, FieldError{"average_size", "must be greater than 0"})
+	}
+	if t.SizeVariation < 0 {
+		errs = append(errs, FieldError{"size_variation", "must not be negative"})
+	} else if t.Enabled && t.SizeVariation >= t.AverageSize {
+		errs = append(errs, FieldError{"size_variation", "must be less than average_size"})
+	}
+	if t.Delay < 0 {
+		errs = append(errs, FieldError{"delay", "must not be negative"})
+	}
+	return
+}
+
 // Returns a list of chunk offsets to slice up a packet of the
 // given total size. For example, for a size of 100, output might be:
 //
@@ -50,7 +65,10 @@ func (t *SlicerToxic) chunk(start int, end int) []int {
 
 	// +1 in the size variation to offset favoring of smaller
 	// numbers by integer division
-	mid := start + (end-start)/2 + (rand.Intn(t.SizeVariation*2) - t.SizeVariation) + rand.Intn(1)
+	mid := start + (end-start)/2
+	if t.SizeVariation > 0 {
+		mid += rand.Intn(t.SizeVariation*2) - t.SizeVariation
+	}
 	left := t.chunk(start, mid)
 	right := t.chunk(mid, end)
 
@@ -60,31 +78,27 @@ func (t *SlicerToxic) chunk(start int, end int) []int {
 func (t *SlicerToxic) Pipe(stub *ToxicStub) {
 	for {
 		select {
-		case <-stub.interrupt:
+		case <-stub.Interrupt:
 			return
-		case c := <-stub.input:
+		case c := <-stub.Input:
 			if c == nil {
 				stub.Close()
 				return
 			}
 
-			chunks := t.chunk(0, len(c.data))
+			chunks := t.chunk(0, len(c.Data))
 			for i := 1; i < len(chunks); i += 2 {
-				stub.output <- &StreamChunk{
-					data:      c.data[chunks[i-1]:chunks[i]],
-					timestamp: c.timestamp,
-				}
+				stub.Output <- c.Slice(chunks[i-1], chunks[i])
 
 				select {
-				case <-stub.interrupt:
-					stub.output <- &StreamChunk{
-						data:      c.data[chunks[i]:],
-						timestamp: c.timestamp,
-					}
+				case <-stub.Interrupt:
+					stub.Output <- c.Slice(chunks[i], len(c.Data))
+					c.Release()
 					return
 				case <-time.After(time.Duration(t.Delay) * time.Microsecond):
 				}
 			}
+			c.Release()
 		}
 	}
 }
@@ -1,4 +1,4 @@
-package main
+package toxiproxy
 
 import "time"
 
@@ -21,23 +21,30 @@ func (t *SlowCloseToxic) SetEnabled(enabled bool) {
 	t.Enabled = enabled
 }
 
+func (t *SlowCloseToxic) Validate() (errs []FieldError) {
+	if t.Delay < 0 {
+		errs = append(errs, FieldError{"delay", "must not be negative"})
+	}
+	return
+}
+
 func (t *SlowCloseToxic) Pipe(stub *ToxicStub) {
 	for {
 		select {
-		case <-stub.interrupt:
+		case <-stub.Interrupt:
 			return
-		case c := <-stub.input:
+		case c := <-stub.Input:
 			if c == nil {
 				delay := time.Duration(t.Delay) * time.Millisecond
 				select {
 				case <-time.After(delay):
 					stub.Close()
 					return
-				case <-stub.interrupt:
+				case <-stub.Interrupt:
 					return
 				}
 			}
-			stub.output <- c
+			stub.Output <- c
 		}
 	}
 }
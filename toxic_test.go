@@ -1,10 +1,16 @@
-package main
+package toxiproxy
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -441,6 +447,71 @@ func TestBandwidthToxic(t *testing.T) {
 	)
 }
 
+// Returns how long the toxic takes to pass through size bytes, in 10KB chunks.
+func TimeBandwidth(toxic *BandwidthToxic, size int) time.Duration {
+	input := make(chan *StreamChunk)
+	output := make(chan *StreamChunk)
+	stub := NewToxicStub(input, output)
+	go toxic.Pipe(stub)
+	go func() {
+		for ; size > 0; size -= 10000 {
+			input <- &StreamChunk{Data: make([]byte, 10000)}
+		}
+		input <- nil
+	}()
+
+	start := time.Now()
+	for range output {
+	}
+	return time.Since(start)
+}
+
+func TestBandwidthToxicBurst(t *testing.T) {
+	toxic := &BandwidthToxic{Enabled: true, Rate: 100, Burst: 50}
+	AssertDeltaTime(t, "Burst", TimeBandwidth(toxic, 50000), 0, 20*time.Millisecond)
+	AssertDeltaTime(t, "After burst", TimeBandwidth(toxic, 60000), 100*time.Millisecond, 20*time.Millisecond)
+}
+
+func TestBandwidthToxicScope(t *testing.T) {
+	for _, scope := range []string{BandwidthConnection, BandwidthProxy} {
+		collection := NewToxicCollection(nil)
+		err := collection.SetToxicValue(&BandwidthToxic{Enabled: true, Rate: 1000, Scope: scope})
+		if err != nil {
+			t.Fatal("Failed to set bandwidth toxic", err)
+		}
+		toxic := collection.GetToxicMap()["bandwidth"].(*BandwidthToxic)
+
+		// Two connections sharing the proxy's bucket each get half of the rate
+		expected := 100 * time.Millisecond
+		if scope == BandwidthProxy {
+			expected *= 2
+		}
+		durations := make(chan time.Duration)
+		for i := 0; i < 2; i++ {
+			go func() { durations <- TimeBandwidth(toxic, 100000) }()
+		}
+		<-durations
+		AssertDeltaTime(t, scope+" scope", <-durations, expected, 20*time.Millisecond)
+	}
+}
+
+func TestBandwidthToxicKeepsBucket(t *testing.T) {
+	collection := NewToxicCollection(nil)
+	first := &BandwidthToxic{Enabled: true, Rate: 1000, Scope: BandwidthProxy}
+	collection.SetToxicValue(first)
+	_, err := collection.SetToxicJson("bandwidth", strings.NewReader(`{"rate": 500}`))
+	if err != nil {
+		t.Fatal("Failed to update bandwidth toxic", err)
+	}
+	second := &BandwidthToxic{Enabled: true, Rate: 100, Scope: BandwidthProxy}
+	collection.SetToxicValue(second)
+
+	updated := collection.GetToxicMap()["bandwidth"].(*BandwidthToxic)
+	if first.bucket == nil || updated.bucket != first.bucket || second.bucket != first.bucket {
+		t.Fatal("Expected updates to keep sharing the bucket")
+	}
+}
+
 func TestSlicerToxic(t *testing.T) {
 	data := []byte(strings.Repeat("hello world ", 40000)) // 480 kb
 	slicer := &SlicerToxic{Enabled: true, AverageSize: 1024, SizeVariation: 512, Delay: 10}
@@ -465,7 +536,7 @@ func TestSlicerToxic(t *testing.T) {
 		}
 	}()
 
-	input <- &StreamChunk{data: data}
+	input <- &StreamChunk{Data: data}
 
 	buf := make([]byte, 0, len(data))
 	reads := 0
@@ -474,7 +545,7 @@ L:
 		select {
 		case c := <-output:
 			reads++
-			buf = append(buf, c.data...)
+			buf = append(buf, c.Data...)
 		case <-time.After(10 * time.Millisecond):
 			break L
 		}
@@ -488,6 +559,755 @@ L:
 	}
 }
 
+func TestSlicerToxicNoVariation(t *testing.T) {
+	slicer := &SlicerToxic{Enabled: true, AverageSize: 10}
+
+	chunks := slicer.chunk(0, 100)
+	if chunks[0] != 0 || chunks[len(chunks)-1] != 100 {
+		t.Fatalf("Expected chunks to cover the whole packet, got %v", chunks)
+	}
+	for i := 1; i < len(chunks); i += 2 {
+		if size := chunks[i] - chunks[i-1]; size <= 0 || size > 10 {
+			t.Fatalf("Expected chunks of at most 10 bytes, got %v", chunks)
+		}
+	}
+}
+
+func TestToxicValidation(t *testing.T) {
+	tests := []struct {
+		toxic  Toxic
+		fields []string
+	}{
+		{&LatencyToxic{Enabled: true, Latency: 100, Jitter: 10}, nil},
+		{&LatencyToxic{Enabled: true, Latency: -1, Jitter: -1}, []string{"latency", "jitter"}},
+		{&LatencyToxic{Distribution: "poisson", Correlation: 101}, []string{"distribution", "correlation"}},
+		{&LatencyToxic{Distribution: DistributionEmpirical}, []string{"histogram"}},
+		{&LatencyToxic{Histogram: []HistogramBucket{{Latency: -1, Weight: 1}}}, []string{"histogram"}},
+		{&BandwidthToxic{Enabled: true, Rate: 0}, []string{"rate"}},
+		{&BandwidthToxic{Enabled: false, Rate: 0}, nil},
+		{&BandwidthToxic{Enabled: true, Rate: 1, Burst: -1, Scope: "global"}, []string{"burst", "scope"}},
+		{&SlicerToxic{Enabled: true, AverageSize: 10, SizeVariation: 10}, []string{"size_variation"}},
+		{&SlicerToxic{Enabled: true, SizeVariation: -1, Delay: -1}, []string{"average_size", "size_variation", "delay"}},
+		{&SlicerToxic{Enabled: false}, nil},
+		{&TimeoutToxic{Timeout: -1}, []string{"timeout"}},
+		{&SlowCloseToxic{Delay: -1}, []string{"delay"}},
+		{&ReorderToxic{Enabled: true, Probability: 101}, []string{"probability", "gap", "timeout"}},
+		{&ReorderToxic{Probability: 50}, nil},
+		{&DuplicateToxic{Probability: -1}, []string{"probability"}},
+		{&DNSToxic{Mode: "refused", Probability: 101, Delay: -1}, []string{"mode", "probability", "delay"}},
+		{&DNSToxic{Mode: DNSModeRedirect, Address: "blackhole"}, []string{"address"}},
+		{&DNSToxic{Mode: DNSModeRedirect, Address: "192.0.2.1"}, nil},
+	}
+
+	for _, test := range tests {
+		errs := test.toxic.Validate()
+		fields := make([]string, len(errs))
+		for i, err := range errs {
+			fields[i] = err.Field
+		}
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") {
+			t.Errorf("Expected %s %+v to have invalid fields %v, got %v", test.toxic.Name(), test.toxic, test.fields, fields)
+		}
+	}
+}
+
+// Samples delays of the toxic in milliseconds, as picked for one connection
+// with random numbers from the seed.
+func SampleLatency(toxic *LatencyToxic, count int, seed int64) []float64 {
+	sampler := toxic.sampler(rand.New(rand.NewSource(seed)))
+	delays := make([]float64, count)
+	for i := range delays {
+		delays[i] = float64(sampler.delay()) / float64(time.Millisecond)
+	}
+	return delays
+}
+
+func meanAndDeviation(values []float64) (mean, deviation float64) {
+	for _, value := range values {
+		mean += value
+	}
+	mean /= float64(len(values))
+	for _, value := range values {
+		deviation += (value - mean) * (value - mean)
+	}
+	return mean, math.Sqrt(deviation / float64(len(values)))
+}
+
+func TestLatencyDistributions(t *testing.T) {
+	for _, distribution := range []string{"", DistributionUniform, DistributionNormal, DistributionPareto, DistributionParetoNormal} {
+		toxic := &LatencyToxic{Enabled: true, Latency: 1000, Jitter: 100, Distribution: distribution}
+		delays := SampleLatency(toxic, 20000, 1)
+		mean, _ := meanAndDeviation(delays)
+		if math.Abs(mean-1000) > 10 {
+			t.Errorf("Expected %q delays to have a mean of 1000ms, got %f", distribution, mean)
+		}
+
+		expected := 100.0
+		if distribution == "" || distribution == DistributionUniform {
+			expected = 100 / math.Sqrt(3)
+		}
+		// The deviation of a sample of the heavy tailed pareto distribution
+		// converges slowly, so use the median of several samples
+		deviations := make([]float64, 5)
+		for i := range deviations {
+			_, deviations[i] = meanAndDeviation(SampleLatency(toxic, 20000, int64(i+2)))
+		}
+		sort.Float64s(deviations)
+		if deviation := deviations[2]; math.Abs(deviation-expected) > expected/5 {
+			t.Errorf("Expected %q delays to have a deviation of %fms, got %f", distribution, expected, deviation)
+		}
+
+		sort.Float64s(delays)
+		if distribution == DistributionPareto && delays[len(delays)-1]-1000 < 5*(1000-delays[0]) {
+			t.Errorf("Expected pareto delays to have a long tail, got %f to %f", delays[0], delays[len(delays)-1])
+		}
+	}
+}
+
+func TestLatencyNeverNegative(t *testing.T) {
+	toxic := &LatencyToxic{Enabled: true, Latency: 10, Jitter: 100, Distribution: DistributionNormal}
+	for _, delay := range SampleLatency(toxic, 1000, 1) {
+		if delay < 0 {
+			t.Fatal("Expected delays to be clamped to 0, got", delay)
+		}
+	}
+}
+
+func TestLatencyEmpiricalDistribution(t *testing.T) {
+	toxic := &LatencyToxic{Enabled: true, Distribution: DistributionEmpirical, Histogram: []HistogramBucket{
+		{Latency: 10, Weight: 3},
+		{Latency: 500, Weight: 1},
+	}}
+	counts := make(map[float64]int)
+	for _, delay := range SampleLatency(toxic, 10000, 1) {
+		counts[delay]++
+	}
+	if len(counts) != 2 {
+		t.Fatal("Expected only delays from the histogram, got", counts)
+	}
+	if counts[10] < 7000 || counts[10] > 8000 {
+		t.Error("Expected 3/4 of the delays to be 10ms, got", counts[10])
+	}
+}
+
+func TestLatencyHistogramUpdate(t *testing.T) {
+	collection := NewToxicCollection(nil)
+	toxic := &LatencyToxic{Enabled: true, Distribution: DistributionEmpirical, Histogram: []HistogramBucket{
+		{Latency: 10, Weight: 1},
+	}}
+	collection.SetToxicValue(toxic)
+
+	_, err := collection.SetToxicJson("latency", strings.NewReader(`{"histogram": [{"latency": -5, "weight": 1}], "latency": -1}`))
+	if err == nil {
+		t.Fatal("Expected update with a negative latency to be rejected")
+	}
+	if collection.GetToxicMap()["latency"] != toxic || toxic.Histogram[0].Latency != 10 {
+		t.Fatalf("Expected rejected update to leave the running toxic unchanged, got %+v", toxic)
+	}
+
+	_, err = collection.SetToxicJson("latency", strings.NewReader(`{"histogram": [{"latency": 20, "weight": 1}]}`))
+	if err != nil {
+		t.Fatal("Failed to update histogram", err)
+	}
+	updated := collection.GetToxicMap()["latency"].(*LatencyToxic)
+	if toxic.Histogram[0].Latency != 10 || updated.Histogram[0].Latency != 20 {
+		t.Fatalf("Expected update to replace the histogram of a copy, got %+v and %+v", toxic, updated)
+	}
+}
+
+// Correlation of each delay with the one before it.
+func autocorrelation(values []float64) float64 {
+	mean, deviation := meanAndDeviation(values)
+	sum := 0.0
+	for i := 1; i < len(values); i++ {
+		sum += (values[i] - mean) * (values[i-1] - mean)
+	}
+	return sum / float64(len(values)-1) / (deviation * deviation)
+}
+
+func TestLatencyCorrelation(t *testing.T) {
+	for _, distribution := range []string{DistributionUniform, DistributionNormal, DistributionPareto} {
+		toxic := &LatencyToxic{Enabled: true, Latency: 1000, Jitter: 100, Distribution: distribution}
+		if c := autocorrelation(SampleLatency(toxic, 10000, 1)); math.Abs(c) > 0.1 {
+			t.Errorf("Expected uncorrelated %s delays, got a correlation of %f", distribution, c)
+		}
+
+		toxic.Correlation = 90
+		if c := autocorrelation(SampleLatency(toxic, 10000, 1)); c < 0.7 {
+			t.Errorf("Expected correlated %s delays, got a correlation of %f", distribution, c)
+		}
+	}
+}
+
+// Runs the toxic on each chunk, returning what it outputs until the output is
+// closed or nothing is sent for a while.
+func RunToxic(t *testing.T, toxic Toxic, chunks ...string) ([]string, bool) {
+	input := make(chan *StreamChunk, len(chunks))
+	output := make(chan *StreamChunk)
+	stub := NewToxicStub(input, output)
+	for _, chunk := range chunks {
+		input <- &StreamChunk{Data: []byte(chunk)}
+	}
+
+	go toxic.Pipe(stub)
+
+	var result []string
+	for {
+		select {
+		case c, ok := <-output:
+			if !ok {
+				return result, true
+			}
+			result = append(result, string(c.Data))
+		case <-time.After(200 * time.Millisecond):
+			stub.Interrupt <- struct{}{}
+			return result, false
+		}
+	}
+}
+
+func TestLatencyToxicPreservesOrder(t *testing.T) {
+	toxic := &LatencyToxic{Enabled: true, Latency: 5, Jitter: 5}
+	output, _ := RunToxic(t, toxic, "a", "b", "c", "d", "e", "f")
+	if strings.Join(output, "") != "abcdef" {
+		t.Fatal("Expected jitter not to reorder chunks, got", output)
+	}
+}
+
+func TestReorderToxic(t *testing.T) {
+	toxic := &ReorderToxic{Enabled: true, Probability: 100, Gap: 2, Timeout: 50}
+	output, closed := RunToxic(t, toxic, "a", "b", "c", "d", "e")
+	if strings.Join(output, ",") != "b,c,a,e,d" || closed {
+		t.Fatalf("Expected held back chunks after later ones, got %v (closed %v)", output, closed)
+	}
+
+	toxic.Probability = 0
+	output, _ = RunToxic(t, toxic, "a", "b", "c")
+	if strings.Join(output, ",") != "a,b,c" {
+		t.Fatal("Expected chunks in order, got", output)
+	}
+}
+
+func TestDuplicateToxic(t *testing.T) {
+	output, _ := RunToxic(t, &DuplicateToxic{Enabled: true, Probability: 100}, "a", "b")
+	if strings.Join(output, ",") != "a,a,b,b" {
+		t.Fatal("Expected every chunk twice, got", output)
+	}
+
+	output, _ = RunToxic(t, &DuplicateToxic{Enabled: true, Probability: 0}, "a", "b")
+	if strings.Join(output, ",") != "a,b" {
+		t.Fatal("Expected every chunk once, got", output)
+	}
+}
+
+func TestDuplicateToxicReleasesChunks(t *testing.T) {
+	input := make(chan *StreamChunk, 1)
+	output := make(chan *StreamChunk, 2)
+	stub := NewToxicStub(input, output)
+	chunk := newStreamChunk([]byte("hello"))
+	buffer := chunk.buffer
+	input <- chunk
+	close(input)
+	(&DuplicateToxic{Enabled: true, Probability: 100}).Pipe(stub)
+
+	first, second := <-output, <-output
+	first.Release()
+	if buffer.refs != 1 || string(second.Data) != "hello" {
+		t.Fatalf("Expected the duplicate to keep the chunk's memory, got %q (%d refs)", second.Data, buffer.refs)
+	}
+	second.Release()
+	if buffer.refs != 0 {
+		t.Fatal("Expected the chunk to be released once both copies were, got", buffer.refs)
+	}
+}
+
+func TestScriptToxic(t *testing.T) {
+	toxic := &ScriptToxic{Enabled: true, Timeout: 100, Script: `
+seen_quit = false
+after_quit = 0
+
+function on_chunk(data)
+  if seen_quit then
+    after_quit = after_quit + 1
+    if after_quit == 3 then
+      drop()
+    end
+  elseif data:find("QUIT", 1, true) then
+    seen_quit = true
+    send(data:lower())
+  end
+end
+`}
+
+	result, closed := RunToxic(t, toxic, "a", "QUIT", "b", "c", "d", "e")
+	if closed {
+		t.Fatal("Expected script toxic not to close the connection")
+	}
+	if strings.Join(result, ",") != "a,quit,b,c,e" {
+		t.Fatalf("Unexpected script toxic output: %v", result)
+	}
+}
+
+func TestScriptToxicSplitDelayClose(t *testing.T) {
+	toxic := &ScriptToxic{Enabled: true, Timeout: 100, Script: `
+function on_chunk(data)
+  split(2)
+  delay(50)
+  close()
+end
+`}
+
+	start := time.Now()
+	result, closed := RunToxic(t, toxic, "hello", "world")
+	if !closed {
+		t.Fatal("Expected script toxic to close the connection")
+	}
+	if strings.Join(result, ",") != "he,ll,o" {
+		t.Fatalf("Unexpected script toxic output: %v", result)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("Expected script toxic to delay closing the connection")
+	}
+}
+
+func TestScriptToxicTimeout(t *testing.T) {
+	toxic := &ScriptToxic{Enabled: true, Timeout: 10, Script: `
+function on_chunk(data)
+  if data == "loop" then
+    while true do end
+  end
+  send(dofile == nil and "sandboxed" or "unsandboxed")
+end
+`}
+
+	result, _ := RunToxic(t, toxic, "loop", "next")
+	if strings.Join(result, ",") != "loop,sandboxed" {
+		t.Fatalf("Expected script to time out and pass the chunk, got %v", result)
+	}
+}
+
+func TestScriptToxicLargeStrings(t *testing.T) {
+	toxic := &ScriptToxic{Enabled: true, Timeout: 100, Script: `
+function on_chunk(data)
+  if data == "rep" then
+    send(string.rep("x", 1e9))
+  elseif data == "format" then
+    send(string.format("%999999999d", 1))
+  elseif data == "concat" then
+    local t = {}
+    for i = 1, 2000 do t[i] = string.rep("x", 1000) end
+    send(table.concat(t))
+  elseif data == "gsub" then
+    send(string.gsub("x", "x", "y"))
+  else
+    send(string.rep(data, 2, "") .. string.format("%3d", 7) .. table.concat({"a", "b"}, ","))
+  end
+end
+`}
+
+	result, _ := RunToxic(t, toxic, "rep", "format", "concat", "gsub", "ok")
+	if strings.Join(result, ",") != "rep,format,concat,gsub,okok  7a,b" {
+		t.Fatalf("Expected large strings to be refused, got %v", result)
+	}
+}
+
+func TestScriptToxicValidation(t *testing.T) {
+	toxic := &ScriptToxic{Enabled: true, Timeout: 100, Script: "function on_chunk(data"}
+	errs := toxic.Validate()
+	if len(errs) != 1 || errs[0].Field != "script" {
+		t.Fatalf("Expected script syntax error, got %+v", errs)
+	}
+
+	toxic = &ScriptToxic{Enabled: true, Timeout: maxScriptTimeout + 1, Script: "function on_chunk(data) end"}
+	errs = toxic.Validate()
+	if len(errs) != 1 || errs[0].Field != "timeout" {
+		t.Fatalf("Expected timeout to be limited, got %+v", errs)
+	}
+}
+
+func TestScriptToxicReleasesChunks(t *testing.T) {
+	toxic := &ScriptToxic{Enabled: true, Timeout: 100, Script: `
+function on_chunk(data)
+  split(2)
+  send("!")
+end
+`}
+
+	input := make(chan *StreamChunk, 1)
+	output := make(chan *StreamChunk, 4)
+	stub := NewToxicStub(input, output)
+	chunk := newStreamChunk([]byte("hello"))
+	buffer := chunk.buffer
+	input <- chunk
+	close(input)
+	toxic.Pipe(stub)
+
+	var result []string
+	shared := 0
+	for c := range output {
+		result = append(result, string(c.Data))
+		if c.buffer == buffer {
+			shared++
+		}
+		c.Release()
+	}
+	if strings.Join(result, ",") != "he,ll,o,!" || shared != 3 {
+		t.Fatalf("Expected the split chunks to share the chunk's memory, got %v (%d shared)", result, shared)
+	}
+	if buffer.refs != 0 {
+		t.Fatal("Expected the chunk to be released once its pieces were, got", buffer.refs)
+	}
+}
+
+func TestMatchToxicAcrossChunks(t *testing.T) {
+	toxic := &MatchToxic{Enabled: true, Pattern: "commit", Toxic: "script", Attributes: map[string]interface{}{
+		"script": "function on_chunk(data) send(data:upper()) end",
+	}}
+	if errs := toxic.Validate(); len(errs) > 0 {
+		t.Fatalf("Expected match toxic to be valid, got %+v", errs)
+	}
+
+	result, closed := RunToxic(t, toxic, "begin;", "com", "mit;", "more")
+	if closed {
+		t.Fatal("Expected match toxic not to close the connection")
+	}
+	if strings.Join(result, ",") != "begin;,com,MIT;,MORE" {
+		t.Fatalf("Unexpected match toxic output: %v", result)
+	}
+}
+
+func TestMatchToxicClose(t *testing.T) {
+	toxic := &MatchToxic{Enabled: true, Regexp: "COMMIT|ROLLBACK", Window: 16, Toxic: "script", Attributes: map[string]interface{}{
+		"script": "function on_chunk(data) pass() close() end",
+	}}
+
+	result, closed := RunToxic(t, toxic, "BEGIN;", "ROLL", "BACK;", "SELECT 1;")
+	if !closed {
+		t.Fatal("Expected match toxic to close the connection")
+	}
+	if strings.Join(result, ",") != "BEGIN;,ROLL,BACK;" {
+		t.Fatalf("Unexpected match toxic output: %v", result)
+	}
+}
+
+func TestMatchToxicHalfOpen(t *testing.T) {
+	toxic := &MatchToxic{Enabled: true, Pattern: "QUIT", Toxic: "half_open", Attributes: map[string]interface{}{
+		"mode": HalfOpenCloseWrite,
+	}}
+
+	input := make(chan *StreamChunk, 3)
+	output := make(chan *StreamChunk, 3)
+	stub := NewToxicStub(input, output)
+	input <- &StreamChunk{Data: []byte("a")}
+	input <- &StreamChunk{Data: []byte("QUIT")}
+	input <- &StreamChunk{Data: []byte("more")}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		toxic.Pipe(stub)
+	}()
+
+	var result []string
+	for c := range output {
+		result = append(result, string(c.Data))
+	}
+	if strings.Join(result, ",") != "a" || !stub.halfClosed {
+		t.Fatalf("Expected match toxic to half close the connection, got %v (half closed %v)", result, stub.halfClosed)
+	}
+
+	// The toxic run by match has to stop too, once the source closes
+	close(input)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected match toxic to return once the source closed")
+	}
+}
+
+func TestMatchToxicValidation(t *testing.T) {
+	tests := []struct {
+		toxic  *MatchToxic
+		fields []string
+	}{
+		{&MatchToxic{Enabled: true, Pattern: "a", Toxic: "latency"}, nil},
+		{&MatchToxic{Enabled: true, Toxic: "latency"}, []string{"pattern"}},
+		{&MatchToxic{Enabled: true, Regexp: "(", Toxic: "latency"}, []string{"regexp", "window"}},
+		{&MatchToxic{Enabled: true, Pattern: "a", Toxic: "match"}, []string{"toxic"}},
+		{&MatchToxic{Enabled: true, Pattern: "a", Toxic: "unknown"}, []string{"toxic"}},
+		{&MatchToxic{Enabled: true, Pattern: "a", Toxic: "latency", Attributes: map[string]interface{}{"latnecy": 1}}, []string{"toxic"}},
+		{&MatchToxic{Enabled: true, Pattern: "a", Toxic: "latency", Attributes: map[string]interface{}{"latency": -1}}, []string{"attributes.latency"}},
+		{&MatchToxic{Enabled: true, Pattern: "a", Toxic: "dns", Attributes: map[string]interface{}{"mode": DNSModeNXDomain}}, []string{"toxic"}},
+	}
+
+	for _, test := range tests {
+		errs := test.toxic.Validate()
+		fields := make([]string, len(errs))
+		for i, err := range errs {
+			fields[i] = err.Field
+		}
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") {
+			t.Errorf("Expected %+v to have invalid fields %v, got %+v", test.toxic, test.fields, errs)
+		}
+	}
+}
+
+func TestMatchToxicRunsOnProxy(t *testing.T) {
+	collection := NewToxicCollection(nil)
+	err := collection.SetToxicValue(&MatchToxic{Enabled: true, Pattern: "a", Toxic: "reorder", Attributes: map[string]interface{}{
+		"probability": 100,
+	}})
+	if err == nil {
+		t.Fatal("Expected match toxic not to run a datagram toxic on a stream")
+	}
+
+	first := &MatchToxic{Enabled: true, Pattern: "a", Toxic: "bandwidth", Attributes: map[string]interface{}{
+		"rate": 1000, "scope": BandwidthProxy,
+	}}
+	if err := collection.SetToxicValue(first); err != nil {
+		t.Fatal("Failed to set match toxic", err)
+	}
+	_, err = collection.SetToxicJson("match", strings.NewReader(`{"attributes": {"rate": 500, "scope": "proxy"}}`))
+	if err != nil {
+		t.Fatal("Failed to update match toxic", err)
+	}
+
+	updated := collection.GetToxicMap()["match"].(*MatchToxic)
+	bucket := first.inner.(*BandwidthToxic).bucket
+	if bucket == nil || updated.inner.(*BandwidthToxic).bucket != bucket {
+		t.Fatal("Expected the bandwidth toxic run by match to keep sharing its bucket")
+	}
+	if updated.inner.(*BandwidthToxic).Rate != 500 {
+		t.Fatal("Expected the bandwidth toxic run by match to be updated")
+	}
+}
+
+func TestSetToxicJsonWhileRunning(t *testing.T) {
+	proxy := NewTestProxy("test", "mock://echo")
+	proxy.Start()
+	defer proxy.Stop()
+
+	_, err := proxy.downToxics.SetToxicJson("match", strings.NewReader(
+		`{"enabled": true, "pattern": "hello", "toxic": "latency", "attributes": {"latency": 1, "jitter": 1}}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to set match toxic", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			conn := AssertProxyUp(t, proxy.Listen, true)
+			Echo(conn, "hello", time.Second)
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		_, err := proxy.downToxics.SetToxicJson("match", strings.NewReader(fmt.Sprintf(`{"attributes": {"latency": %d}}`, i%5)))
+		if err != nil {
+			t.Fatal("Failed to update match toxic", err)
+		}
+	}
+	<-done
+
+	toxic := proxy.downToxics.GetToxicMap()["match"].(*MatchToxic)
+	if _, ok := toxic.Attributes["jitter"]; ok || !toxic.Enabled || toxic.Pattern != "hello" {
+		t.Fatalf("Expected attributes to be replaced and other fields kept, got %+v", toxic)
+	}
+}
+
+// Starts a proxy with the toxic, returning the client side of a connection
+// through it, and the upstream side of that connection.
+func TestDNSToxicModes(t *testing.T) {
+	lookups := 0
+	lookup := func(ctx context.Context, upstream string) ([]string, error) {
+		lookups++
+		return []string{"127.0.0.2:3306", "127.0.0.3:3306"}, nil
+	}
+
+	toxic := &DNSToxic{Enabled: true, Mode: DNSModeNXDomain, Probability: 100}
+	_, err := toxic.Resolve(context.Background(), "db.toxiproxy.test:3306", lookup)
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound || dnsErr.Name != "db.toxiproxy.test" {
+		t.Fatal("Expected not found error, got", err)
+	}
+
+	toxic.Mode = DNSModeServFail
+	_, err = toxic.Resolve(context.Background(), "srv://_db._tcp.toxiproxy.test", lookup)
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.Temporary() || dnsErr.Name != "_db._tcp.toxiproxy.test" {
+		t.Fatal("Expected temporary error, got", err)
+	}
+
+	toxic.Mode = DNSModeRedirect
+	toxic.Address = "192.0.2.1"
+	addrs, err := toxic.Resolve(context.Background(), "db.toxiproxy.test:3306", lookup)
+	if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.1:3306" {
+		t.Fatal("Expected upstream to be redirected, got", addrs, err)
+	}
+	addrs, err = toxic.Resolve(context.Background(), "srv://_db._tcp.toxiproxy.test", lookup)
+	if err != nil || len(addrs) != 2 || addrs[0] != "192.0.2.1:3306" {
+		t.Fatal("Expected SRV targets to be redirected, got", addrs, err)
+	}
+	if lookups != 1 {
+		t.Fatal("Expected only the SRV upstream to be looked up, got lookups:", lookups)
+	}
+
+	toxic.Probability = 0
+	addrs, err = toxic.Resolve(context.Background(), "db.toxiproxy.test:3306", lookup)
+	if err != nil || addrs[0] != "127.0.0.2:3306" || lookups != 2 {
+		t.Fatal("Expected lookup to be untouched with a probability of 0, got", addrs, err)
+	}
+}
+
+func TestDNSToxicDelay(t *testing.T) {
+	lookup := func(ctx context.Context, upstream string) ([]string, error) {
+		return []string{"127.0.0.2:3306"}, nil
+	}
+	toxic := &DNSToxic{Enabled: true, Mode: DNSModeDelay, Probability: 100, Delay: 100}
+
+	start := time.Now()
+	addrs, err := toxic.Resolve(context.Background(), "db.toxiproxy.test:3306", lookup)
+	if err != nil || len(addrs) != 1 {
+		t.Fatal("Expected lookup to succeed after the delay, got", addrs, err)
+	}
+	AssertDeltaTime(t, "DNS delay", time.Since(start), 100*time.Millisecond, 20*time.Millisecond)
+
+	// The delay is given up when the proxy stops
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	_, err = toxic.Resolve(ctx, "db.toxiproxy.test:3306", lookup)
+	if err != context.Canceled {
+		t.Fatal("Expected delay to be cancelled, got", err)
+	}
+	AssertDeltaTime(t, "Cancelled DNS delay", time.Since(start), 0, 20*time.Millisecond)
+}
+
+func TestDNSToxicOnProxy(t *testing.T) {
+	WithTCPServer(t, func(upstream string, response chan []byte) {
+		_, port, _ := net.SplitHostPort(upstream)
+
+		dns := NewTestDNSServer(t)
+		defer dns.Close()
+
+		// The upstream doesn't exist, but the toxic redirects it to the server
+		proxy := NewTestProxy("test", "db.toxiproxy.test:"+port)
+		proxy.resolver = NewResolver(dns.Addr, 0)
+		proxy.Start()
+		defer proxy.Stop()
+
+		err := proxy.AddToxic(Upstream, &DNSToxic{Mode: DNSModeNXDomain, Probability: 100})
+		if err != nil {
+			t.Fatal("Failed to add toxic", err)
+		}
+		conn := AssertProxyUp(t, proxy.Listen, true)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatal("Expected proxy to close client when lookup fails, got", err)
+		}
+		if proxy.ResolveErrors() != 1 || dns.Queries("db.toxiproxy.test") != 0 {
+			t.Fatal("Expected lookup to fail without querying DNS, got resolve errors:", proxy.ResolveErrors())
+		}
+
+		err = proxy.AddToxic(Upstream, &DNSToxic{Mode: DNSModeRedirect, Probability: 100, Address: "127.0.0.1"})
+		if err != nil {
+			t.Fatal("Failed to add toxic", err)
+		}
+		conn = AssertProxyUp(t, proxy.Listen, true)
+		conn.Write([]byte("hello"))
+		conn.Close()
+		if resp := <-response; string(resp) != "hello" {
+			t.Fatalf("Expected redirected upstream to receive hello, got %q", resp)
+		}
+	})
+}
+
+func WithToxicConnection(t *testing.T, direction string, toxic Toxic, f func(client, upstream net.Conn)) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	proxy := NewTestProxy("test", ln.Addr().String())
+	proxy.Start()
+	defer proxy.Stop()
+
+	err = proxy.AddToxic(direction, toxic)
+	if err != nil {
+		t.Fatal("Failed to add toxic", err)
+	}
+
+	client, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer client.Close()
+	upstream, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unable to accept TCP connection", err)
+	}
+	defer upstream.Close()
+
+	f(client, upstream)
+}
+
+func TestHalfOpenToxicCloseWrite(t *testing.T) {
+	WithToxicConnection(t, Upstream, &HalfOpenToxic{Mode: HalfOpenCloseWrite}, func(client, upstream net.Conn) {
+		upstream.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := upstream.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Fatal("Expected upstream to receive a FIN, got", err)
+		}
+
+		// The client can still write, but nothing arrives
+		_, err = client.Write([]byte("ignored"))
+		if err != nil {
+			t.Fatal("Expected client to still be able to write", err)
+		}
+
+		// The other direction stays open
+		AssertWritesThrough(t, upstream, client, "hello")
+
+		upstream.Close()
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = client.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Fatal("Expected client to be closed once upstream closed, got", err)
+		}
+	})
+}
+
+func TestHalfOpenToxicBlackhole(t *testing.T) {
+	WithToxicConnection(t, Downstream, &HalfOpenToxic{Mode: HalfOpenBlackhole}, func(client, upstream net.Conn) {
+		_, err := upstream.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal("Expected upstream to be able to write", err)
+		}
+
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = client.Read(make([]byte, 1))
+		if err, ok := err.(net.Error); !ok || !err.Timeout() {
+			t.Fatal("Expected client to never receive data, got", err)
+		}
+
+		AssertWritesThrough(t, client, upstream, "world")
+	})
+}
+
+func AssertWritesThrough(t *testing.T, from, to net.Conn, data string) {
+	_, err := from.Write([]byte(data))
+	if err != nil {
+		t.Fatal("Failed writing", err)
+	}
+	buf := make([]byte, len(data))
+	to.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(to, buf)
+	if err != nil || string(buf) != data {
+		t.Fatalf("Expected to read %q, got %q: %v", data, buf, err)
+	}
+}
+
 func TestToxicUpdate(t *testing.T) {
 	ln, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
@@ -543,6 +1363,151 @@ func TestToxicUpdate(t *testing.T) {
 	}
 }
 
+// Returns the states of the collection's links.
+func LinkStates(collection *ToxicCollection) []int {
+	collection.Lock()
+	defer collection.Unlock()
+
+	var states []int
+	for _, link := range collection.links {
+		link.Lock()
+		states = append(states, link.state)
+		link.Unlock()
+	}
+	return states
+}
+
+func TestLinkSplicesUntilToxicEnabled(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	proxy := NewTestProxy("test", ln.Addr().String())
+	proxy.Start()
+	defer proxy.Stop()
+
+	serverConnRecv := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error("Unable to accept TCP connection", err)
+		}
+		serverConnRecv <- conn
+	}()
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial TCP server", err)
+	}
+	serverConn := <-serverConnRecv
+	defer serverConn.Close()
+
+	// The proxy starts the links after connecting to the upstream
+	states := LinkStates(proxy.upToxics)
+	for i := 0; i < 100 && len(states) == 0; i++ {
+		time.Sleep(time.Millisecond)
+		states = LinkStates(proxy.upToxics)
+	}
+	if len(states) != 1 || states[0] != linkSplicing {
+		t.Fatal("Expected link without toxics to splice, got states", states)
+	}
+
+	// Enable a toxic halfway through a stream of numbered writes
+	var expected bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&expected, "%d\n", i)
+	}
+	data := expected.Bytes()
+	go func() {
+		for i := 0; i < len(data); i += 1000 {
+			end := i + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			if i == len(data)/2000*1000 {
+				proxy.upToxics.SetToxicValue(&LatencyToxic{Enabled: true, Latency: 1})
+				if states := LinkStates(proxy.upToxics); len(states) != 1 || states[0] != linkPiping {
+					t.Error("Expected link to run the toxics, got states", states)
+				}
+				if states := LinkStates(proxy.downToxics); len(states) != 1 || states[0] != linkSplicing {
+					t.Error("Expected downstream link to still splice, got states", states)
+				}
+			}
+			conn.Write(data[i:end])
+		}
+		conn.Close()
+	}()
+
+	received, err := ioutil.ReadAll(serverConn)
+	if err != nil {
+		t.Fatal("Failed to read from proxy", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("Expected %d bytes in order, got %d bytes", len(data), len(received))
+	}
+}
+
+func TestStopSplicingSlowDestination(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	proxy := NewTestProxy("test", ln.Addr().String())
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial TCP server", err)
+	}
+	defer conn.Close()
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unable to accept TCP connection", err)
+	}
+	defer serverConn.Close()
+
+	// Fill the socket buffers while the upstream isn't reading, so the spliced
+	// copy is stuck writing
+	written := make(chan int)
+	go func() {
+		total := 0
+		data := make([]byte, 32*1024)
+		conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			n, err := conn.Write(data)
+			total += n
+			if err != nil {
+				written <- total
+				return
+			}
+		}
+	}()
+	total := <-written
+
+	enabled := make(chan struct{})
+	go func() {
+		defer close(enabled)
+		proxy.upToxics.SetToxicValue(&LatencyToxic{Enabled: true, Latency: 1})
+	}()
+	select {
+	case <-enabled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected enabling a toxic not to wait for a stuck write")
+	}
+
+	// Nothing is lost once the upstream reads again
+	conn.Close()
+	received, err := ioutil.ReadAll(serverConn)
+	if err != nil || len(received) != total {
+		t.Fatalf("Expected upstream to receive %d bytes, got %d: %v", total, len(received), err)
+	}
+}
+
 func BenchmarkBandwidthToxic100MB(b *testing.B) {
 	ln, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
@@ -1,4 +1,4 @@
-package main
+package toxiproxy
 
 import "time"
 
@@ -22,6 +22,13 @@ func (t *TimeoutToxic) SetEnabled(enabled bool) {
 	t.Enabled = enabled
 }
 
+func (t *TimeoutToxic) Validate() (errs []FieldError) {
+	if t.Timeout < 0 {
+		errs = append(errs, FieldError{"timeout", "must not be negative"})
+	}
+	return
+}
+
 func (t *TimeoutToxic) Pipe(stub *ToxicStub) {
 	timeout := time.Duration(t.Timeout) * time.Millisecond
 	if timeout > 0 {
@@ -29,11 +36,11 @@ func (t *TimeoutToxic) Pipe(stub *ToxicStub) {
 		case <-time.After(timeout):
 			stub.Close()
 			return
-		case <-stub.interrupt:
+		case <-stub.Interrupt:
 			return
 		}
 	} else {
-		<-stub.interrupt
+		<-stub.Interrupt
 		return
 	}
 }
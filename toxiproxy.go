@@ -1,26 +1,13 @@
-package main
-
-import (
-	"flag"
-	"math/rand"
-	"time"
-)
+// Package toxiproxy is a TCP proxy to simulate network and system conditions.
+// The toxiproxy command serves its HTTP API, but proxies can also be run
+// in-process, for example in a Go test:
+//
+//     server := toxiproxy.NewServer()
+//     defer server.Close()
+//
+//     proxy, err := server.CreateProxy("redis", "localhost:0", "localhost:6379")
+//     err = proxy.AddToxic(toxiproxy.Downstream, &toxiproxy.LatencyToxic{Latency: 100})
+//
+package toxiproxy
 
 var Version = "1.2.1"
-
-var host string
-var port string
-
-func init() {
-	flag.StringVar(&host, "host", "localhost", "Host for toxiproxy's API to listen on")
-	flag.StringVar(&port, "port", "8474", "Port for toxiproxy's API to listen on")
-	seed := flag.Int64("seed", time.Now().UTC().UnixNano(), "Seed for randomizing toxics with")
-	flag.Parse()
-	rand.Seed(*seed)
-}
-
-func main() {
-	proxies := NewProxyCollection()
-	server := NewServer(proxies)
-	server.Listen(host, port)
-}
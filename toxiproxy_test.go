@@ -0,0 +1,85 @@
+package toxiproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedServer(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(func() {
+		err := server.Close()
+		if err != nil {
+			t.Error("Failed to close server", err)
+		}
+	})
+
+	proxy, err := server.CreateProxy("echo", "localhost:0", "mock://echo")
+	if err != nil {
+		t.Fatal("Failed to create proxy", err)
+	}
+	if proxy.Listen == "localhost:0" {
+		t.Fatal("Expected proxy to listen on an ephemeral port")
+	}
+
+	err = proxy.AddToxic(Downstream, &LatencyToxic{Latency: 100})
+	if err != nil {
+		t.Fatal("Failed to add toxic", err)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	_, err = conn.Write([]byte("hello\n"))
+	if err != nil {
+		t.Fatal("Failed writing to proxy", err)
+	}
+	buf := make([]byte, 6)
+	_, err = conn.Read(buf)
+	if err != nil {
+		t.Fatal("Failed reading from proxy", err)
+	}
+	if string(buf) != "hello\n" {
+		t.Fatalf("Expected echo, got %q", buf)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("Expected latency toxic to delay the echo, took %v", elapsed)
+	}
+
+	err = proxy.RemoveToxic(Downstream, "latency")
+	if err != nil {
+		t.Fatal("Failed to remove toxic", err)
+	}
+	if proxy.downToxics.GetToxicMap()["latency"].IsEnabled() {
+		t.Fatal("Expected latency toxic to be disabled")
+	}
+}
+
+func TestEmbeddedServerInvalidToxic(t *testing.T) {
+	server := NewServer()
+	t.Cleanup(func() { server.Close() })
+
+	proxy, err := server.CreateProxy("echo", "localhost:0", "mock://echo")
+	if err != nil {
+		t.Fatal("Failed to create proxy", err)
+	}
+
+	err = proxy.AddToxic("sideways", &LatencyToxic{})
+	if err == nil || err.Error() != "Invalid toxic direction: sideways" {
+		t.Fatal("Expected invalid direction to be rejected", err)
+	}
+	err = proxy.AddToxic(Upstream, &LatencyToxic{Latency: -1})
+	if err == nil || err.Error() != "Invalid toxic: latency must not be negative" {
+		t.Fatal("Expected invalid toxic to be rejected", err)
+	}
+
+	_, err = server.CreateProxy("echo", "localhost:0", "mock://echo")
+	if err == nil {
+		t.Fatal("Expected duplicate proxy to be rejected")
+	}
+}